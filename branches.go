@@ -0,0 +1,146 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+
+	"golang.org/x/tools/cover"
+)
+
+// Go cover profiles have no branch data, but the cover tool puts a counter
+// at the start of every arm of if, switch and select statements. So the hit
+// count of an arm is the count of the first block in it, and the number of
+// times a statement is reached is the count of the block containing it.
+//
+// Arms that don't exist in the source, the missing else of an if and the
+// missing default of a switch, are reported as branches too. Their counts
+// are derived by subtracting the counts of the other arms. With the "set"
+// cover mode, an implicit arm is only reported as taken if no other arm was.
+
+// branchCoverage returns the branches of the Go source src in the format of
+// the Coveralls API: a flat list of [line, block, branch, hits].
+func branchCoverage(filename string, src []byte, blocks []cover.ProfileBlock, mode string) ([]int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := &branchCollector{
+		fset:   fset,
+		blocks: blocks,
+		set:    mode == "set",
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.IfStmt:
+			arms := []int{bc.armCount(n.Body.Lbrace, n.Body.Rbrace)}
+			if n.Else != nil {
+				arms = append(arms, bc.armCount(n.Body.End(), n.Else.End()))
+			}
+			bc.add(n.Pos(), arms, n.Else == nil)
+		case *ast.SwitchStmt:
+			bc.addClauses(n.Pos(), n.Body)
+		case *ast.TypeSwitchStmt:
+			bc.addClauses(n.Pos(), n.Body)
+		case *ast.SelectStmt:
+			bc.addClauses(n.Pos(), n.Body)
+		}
+		return true
+	})
+	return bc.branches, nil
+}
+
+type branchCollector struct {
+	fset     *token.FileSet
+	blocks   []cover.ProfileBlock
+	set      bool
+	block    int
+	branches []int
+}
+
+// addClauses adds the case clauses of a switch or select statement.
+func (bc *branchCollector) addClauses(pos token.Pos, body *ast.BlockStmt) {
+	if body == nil || len(body.List) == 0 {
+		return
+	}
+	var arms []int
+	hasDefault := false
+	isSelect := false
+	for _, stmt := range body.List {
+		switch clause := stmt.(type) {
+		case *ast.CaseClause:
+			hasDefault = hasDefault || clause.List == nil
+			arms = append(arms, bc.armCount(clause.Colon, clause.End()))
+		case *ast.CommClause:
+			isSelect = true
+			arms = append(arms, bc.armCount(clause.Colon, clause.End()))
+		}
+	}
+	// select blocks until one of its cases is ready, so it has no implicit arm.
+	bc.add(pos, arms, !hasDefault && !isSelect)
+}
+
+// add adds the branches of the statement at pos. If implicit is true, an
+// arm which isn't written in the source is appended.
+func (bc *branchCollector) add(pos token.Pos, arms []int, implicit bool) {
+	if implicit {
+		reached := bc.countAt(pos)
+		taken := 0
+		for _, c := range arms {
+			taken += c
+		}
+		rest := reached - taken
+		if bc.set {
+			rest = 0
+			if reached > 0 && taken == 0 {
+				rest = 1
+			}
+		}
+		if rest < 0 {
+			rest = 0
+		}
+		arms = append(arms, rest)
+	}
+
+	line := bc.fset.Position(pos).Line
+	for i, c := range arms {
+		bc.branches = append(bc.branches, line, bc.block, i, c)
+	}
+	bc.block++
+}
+
+// armCount returns the count of the first block which starts between from
+// and to.
+func (bc *branchCollector) armCount(from, to token.Pos) int {
+	start, end := bc.fset.Position(from), bc.fset.Position(to)
+	for _, b := range bc.blocks {
+		if !before(b.StartLine, b.StartCol, start) && !after(b.StartLine, b.StartCol, end) {
+			return b.Count
+		}
+	}
+	return 0
+}
+
+// countAt returns the count of the block containing pos.
+func (bc *branchCollector) countAt(pos token.Pos) int {
+	p := bc.fset.Position(pos)
+	for _, b := range bc.blocks {
+		if !before(p.Line, p.Column, token.Position{Line: b.StartLine, Column: b.StartCol}) &&
+			before(p.Line, p.Column, token.Position{Line: b.EndLine, Column: b.EndCol}) {
+			return b.Count
+		}
+	}
+	return 0
+}
+
+// before reports whether line:col is before p.
+func before(line, col int, p token.Position) bool {
+	return line < p.Line || (line == p.Line && col < p.Column)
+}
+
+// after reports whether line:col is after p.
+func after(line, col int, p token.Position) bool {
+	return line > p.Line || (line == p.Line && col > p.Column)
+}
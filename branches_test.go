@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+const branchTestSource = `package bt
+
+func Sign(n int) int {
+	if n < 0 {
+		return -1
+	} else if n == 0 {
+		return 0
+	}
+	return 1
+}
+
+func Name(n int) string {
+	switch n {
+	case 1:
+		return "one"
+	case 2:
+		return "two"
+	}
+	if n > 100 {
+		return "big"
+	}
+	return "many"
+}
+`
+
+// branchTestBlocks is the profile of branchTestSource after calling
+// Sign(-1), Sign(-2), Sign(5), Name(1) and Name(3).
+var branchTestBlocks = []cover.ProfileBlock{
+	{StartLine: 4, StartCol: 2, EndLine: 4, EndCol: 11, NumStmt: 1, Count: 3},
+	{StartLine: 5, StartCol: 3, EndLine: 6, EndCol: 1, NumStmt: 1, Count: 2},
+	{StartLine: 6, StartCol: 9, EndLine: 6, EndCol: 19, NumStmt: 1, Count: 1},
+	{StartLine: 7, StartCol: 3, EndLine: 8, EndCol: 1, NumStmt: 1, Count: 0},
+	{StartLine: 9, StartCol: 2, EndLine: 9, EndCol: 10, NumStmt: 1, Count: 1},
+	{StartLine: 13, StartCol: 2, EndLine: 13, EndCol: 11, NumStmt: 1, Count: 2},
+	{StartLine: 15, StartCol: 3, EndLine: 15, EndCol: 15, NumStmt: 1, Count: 1},
+	{StartLine: 17, StartCol: 3, EndLine: 17, EndCol: 15, NumStmt: 1, Count: 0},
+	{StartLine: 19, StartCol: 2, EndLine: 19, EndCol: 13, NumStmt: 1, Count: 1},
+	{StartLine: 20, StartCol: 3, EndLine: 21, EndCol: 1, NumStmt: 1, Count: 0},
+	{StartLine: 22, StartCol: 2, EndLine: 22, EndCol: 15, NumStmt: 1, Count: 1},
+}
+
+func TestBranchCoverage(t *testing.T) {
+	t.Parallel()
+
+	got, err := branchCoverage("bt.go", []byte(branchTestSource), branchTestBlocks, "count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{
+		// if n < 0 {} else if ...
+		4, 0, 0, 2,
+		4, 0, 1, 1,
+		// if n == 0 {} with the implicit else
+		6, 1, 0, 0,
+		6, 1, 1, 1,
+		// switch n with the implicit default
+		13, 2, 0, 1,
+		13, 2, 1, 0,
+		13, 2, 2, 1,
+		// if n > 100 {} with the implicit else
+		19, 3, 0, 0,
+		19, 3, 1, 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("branchCoverage() = %v, want %v", got, want)
+	}
+}
+
+func TestBranchCoverageSetMode(t *testing.T) {
+	t.Parallel()
+
+	blocks := make([]cover.ProfileBlock, len(branchTestBlocks))
+	for i, b := range branchTestBlocks {
+		if b.Count > 0 {
+			b.Count = 1
+		}
+		blocks[i] = b
+	}
+	got, err := branchCoverage("bt.go", []byte(branchTestSource), blocks, "set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the implicit default of the switch can't be told from the set
+	// profile since one of the cases was taken.
+	want := []int{13, 2, 2, 0}
+	if !reflect.DeepEqual(got[24:28], want) {
+		t.Errorf("branches of the switch = %v, want %v", got[24:28], want)
+	}
+}
+
+func TestBranchCoverageParseError(t *testing.T) {
+	t.Parallel()
+
+	if _, err := branchCoverage("bad.go", []byte("package"), nil, "count"); err == nil {
+		t.Error("expected a parse error")
+	}
+}
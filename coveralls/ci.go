@@ -0,0 +1,388 @@
+package coveralls
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Getenv retrieves the value of an environment variable. os.Getenv
+// satisfies it.
+type Getenv func(key string) string
+
+// A CIInfo describes the build of a CI service that a job runs in.
+type CIInfo struct {
+	ServiceName string // Name of the CI service known by Coveralls, e.g. "travis-ci"
+	JobID       string // ID of the job or build
+	JobNumber   string // Human readable number of the job, if any
+	PullRequest string // Pull request number, if the build is for a pull request
+	Branch      string // Branch being built
+	CommitSHA   string // Commit being built
+	BuildURL    string // Web page of the build
+
+	// HeadRef is the commit to report if HEAD of the checkout isn't the
+	// commit being built, like the merge commit of a GitHub pull request.
+	HeadRef string
+}
+
+// A CIProvider detects a CI service and reads the metadata of the current
+// build from its environment variables.
+type CIProvider interface {
+	// Detect reports whether the build runs on the CI service.
+	Detect(getenv Getenv) bool
+
+	// Info returns the metadata of the build. It's only called when
+	// Detect reports true. If only the pull request can't be read, it
+	// returns the rest of the metadata along with the error.
+	Info(getenv Getenv) (*CIInfo, error)
+}
+
+var ciProviders = []CIProvider{
+	travisProvider{},
+	circleCIProvider{},
+	appVeyorProvider{},
+	semaphoreProvider{},
+	jenkinsProvider{},
+	buildkiteProvider{},
+	droneProvider{},
+	codeshipProvider{},
+	githubProvider{},
+	gitlabProvider{},
+	werckerProvider{},
+	teamCityProvider{},
+}
+
+// RegisterCIProvider adds p to the providers tried by DetectCI. Providers
+// are tried in the order of registration, after the built-in ones.
+func RegisterCIProvider(p CIProvider) {
+	ciProviders = append(ciProviders, p)
+}
+
+// DetectCI returns the metadata of the build from the first provider
+// which detects its CI service. If no provider matches, the generic
+// variables CI_NAME, CI_JOB_ID, CI_BRANCH, CI_PULL_REQUEST, etc. are used.
+// If the pull request of the build can't be read, the rest of the metadata
+// is returned along with the error.
+func DetectCI(getenv Getenv) (*CIInfo, error) {
+	for _, p := range ciProviders {
+		if p.Detect(getenv) {
+			return p.Info(getenv)
+		}
+	}
+	return genericProvider{}.Info(getenv)
+}
+
+// firstEnv returns the first non-empty value of the environment variables.
+func firstEnv(getenv Getenv, keys ...string) string {
+	for _, key := range keys {
+		if v := getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var trailingNumber = regexp.MustCompile(`[0-9]+$`)
+
+// prNumberFromURL extracts the pull request number from its URL.
+func prNumberFromURL(u string) string {
+	return trailingNumber.FindString(u)
+}
+
+// prNumber returns s unless it's one of the placeholders CI services use
+// for builds which aren't for a pull request.
+func prNumber(s string) string {
+	if s == "false" || s == "0" {
+		return ""
+	}
+	return s
+}
+
+// https://docs.travis-ci.com/user/environment-variables/
+type travisProvider struct{}
+
+func (travisProvider) Detect(getenv Getenv) bool {
+	return getenv("TRAVIS") == "true" || getenv("TRAVIS_JOB_ID") != ""
+}
+
+func (travisProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "travis-ci",
+		JobID:       getenv("TRAVIS_JOB_ID"),
+		JobNumber:   getenv("TRAVIS_JOB_NUMBER"),
+		PullRequest: prNumber(getenv("TRAVIS_PULL_REQUEST")),
+		Branch:      getenv("TRAVIS_BRANCH"),
+		CommitSHA:   getenv("TRAVIS_COMMIT"),
+		BuildURL:    getenv("TRAVIS_BUILD_WEB_URL"),
+	}, nil
+}
+
+// https://circleci.com/docs/variables/
+type circleCIProvider struct{}
+
+func (circleCIProvider) Detect(getenv Getenv) bool {
+	return getenv("CIRCLECI") == "true"
+}
+
+func (circleCIProvider) Info(getenv Getenv) (*CIInfo, error) {
+	info := &CIInfo{
+		ServiceName: "circleci",
+		JobID:       getenv("CIRCLE_BUILD_NUM"),
+		Branch:      getenv("CIRCLE_BRANCH"),
+		CommitSHA:   getenv("CIRCLE_SHA1"),
+		BuildURL:    getenv("CIRCLE_BUILD_URL"),
+	}
+	if pr := getenv("CIRCLE_PR_NUMBER"); pr != "" {
+		// pull request from forked repo
+		info.PullRequest = pr
+	} else if prURL := firstEnv(getenv, "CIRCLE_PULL_REQUEST", "CI_PULL_REQUEST"); prURL != "" {
+		info.PullRequest = prNumberFromURL(prURL)
+	}
+	return info, nil
+}
+
+// https://www.appveyor.com/docs/environment-variables/
+type appVeyorProvider struct{}
+
+func (appVeyorProvider) Detect(getenv Getenv) bool {
+	return strings.EqualFold(getenv("APPVEYOR"), "true")
+}
+
+func (appVeyorProvider) Info(getenv Getenv) (*CIInfo, error) {
+	info := &CIInfo{
+		ServiceName: "appveyor",
+		JobID:       getenv("APPVEYOR_JOB_ID"),
+		JobNumber:   getenv("APPVEYOR_JOB_NUMBER"),
+		PullRequest: getenv("APPVEYOR_PULL_REQUEST_NUMBER"),
+		Branch:      getenv("APPVEYOR_REPO_BRANCH"),
+		CommitSHA:   getenv("APPVEYOR_REPO_COMMIT"),
+	}
+	if u := getenv("APPVEYOR_URL"); u != "" {
+		info.BuildURL = fmt.Sprintf("%s/project/%s/%s/builds/%s", u,
+			getenv("APPVEYOR_ACCOUNT_NAME"), getenv("APPVEYOR_PROJECT_SLUG"), getenv("APPVEYOR_BUILD_ID"))
+	}
+	return info, nil
+}
+
+// https://docs.semaphoreci.com/ci-cd-environment/environment-variables/
+type semaphoreProvider struct{}
+
+func (semaphoreProvider) Detect(getenv Getenv) bool {
+	return getenv("SEMAPHORE") == "true"
+}
+
+func (semaphoreProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "semaphore",
+		JobID:       firstEnv(getenv, "SEMAPHORE_BUILD_NUMBER", "SEMAPHORE_JOB_ID"),
+		PullRequest: firstEnv(getenv, "PULL_REQUEST_NUMBER", "SEMAPHORE_GIT_PR_NUMBER"),
+		Branch:      firstEnv(getenv, "BRANCH_NAME", "SEMAPHORE_GIT_BRANCH"),
+		CommitSHA:   firstEnv(getenv, "REVISION", "SEMAPHORE_GIT_SHA"),
+	}, nil
+}
+
+// https://www.jenkins.io/doc/book/pipeline/jenkinsfile/#using-environment-variables
+type jenkinsProvider struct{}
+
+func (jenkinsProvider) Detect(getenv Getenv) bool {
+	return getenv("JENKINS_URL") != ""
+}
+
+func (jenkinsProvider) Info(getenv Getenv) (*CIInfo, error) {
+	info := &CIInfo{
+		ServiceName: "jenkins",
+		JobID:       getenv("BUILD_NUMBER"),
+		Branch:      getenv("BRANCH_NAME"),
+		CommitSHA:   getenv("GIT_COMMIT"),
+		BuildURL:    getenv("BUILD_URL"),
+	}
+	// for Jenkins multibranch projects
+	if pr := getenv("CHANGE_ID"); pr != "" {
+		info.PullRequest = pr
+	} else if prURL := getenv("CHANGE_URL"); prURL != "" {
+		info.PullRequest = prNumberFromURL(prURL)
+	}
+	return info, nil
+}
+
+// https://buildkite.com/docs/pipelines/environment-variables
+type buildkiteProvider struct{}
+
+func (buildkiteProvider) Detect(getenv Getenv) bool {
+	return getenv("BUILDKITE") == "true"
+}
+
+func (buildkiteProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "buildkite",
+		JobID:       firstEnv(getenv, "BUILDKITE_BUILD_ID", "BUILDKITE_BUILD_NUMBER"),
+		PullRequest: prNumber(getenv("BUILDKITE_PULL_REQUEST")),
+		Branch:      getenv("BUILDKITE_BRANCH"),
+		CommitSHA:   getenv("BUILDKITE_COMMIT"),
+		BuildURL:    getenv("BUILDKITE_BUILD_URL"),
+	}, nil
+}
+
+// https://docs.drone.io/pipeline/environment/reference/
+type droneProvider struct{}
+
+func (droneProvider) Detect(getenv Getenv) bool {
+	return getenv("DRONE") == "true"
+}
+
+func (droneProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "drone",
+		JobID:       getenv("DRONE_BUILD_NUMBER"),
+		PullRequest: getenv("DRONE_PULL_REQUEST"),
+		Branch:      getenv("DRONE_BRANCH"),
+		CommitSHA:   firstEnv(getenv, "DRONE_COMMIT_SHA", "DRONE_COMMIT"),
+		BuildURL:    getenv("DRONE_BUILD_LINK"),
+	}, nil
+}
+
+// https://docs.cloudbees.com/docs/cloudbees-codeship/latest/basic-builds-and-configuration/set-environment-variables
+type codeshipProvider struct{}
+
+func (codeshipProvider) Detect(getenv Getenv) bool {
+	return strings.EqualFold(getenv("CI_NAME"), "codeship")
+}
+
+func (codeshipProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "codeship",
+		JobID:       getenv("CI_BUILD_ID"),
+		JobNumber:   getenv("CI_BUILD_NUMBER"),
+		PullRequest: prNumber(getenv("CI_PR_NUMBER")),
+		Branch:      getenv("CI_BRANCH"),
+		CommitSHA:   getenv("CI_COMMIT_ID"),
+		BuildURL:    getenv("CI_BUILD_URL"),
+	}, nil
+}
+
+// https://docs.github.com/en/actions/learn-github-actions/variables#default-environment-variables
+type githubProvider struct{}
+
+func (githubProvider) Detect(getenv Getenv) bool {
+	return getenv("GITHUB_ACTIONS") == "true"
+}
+
+func (githubProvider) Info(getenv Getenv) (*CIInfo, error) {
+	info := &CIInfo{
+		ServiceName: "github",
+		JobID:       getenv("GITHUB_RUN_ID"),
+		Branch:      getenv("GITHUB_HEAD_REF"),
+		CommitSHA:   getenv("GITHUB_SHA"),
+	}
+	if info.Branch == "" {
+		info.Branch = strings.TrimPrefix(getenv("GITHUB_REF"), "refs/heads/")
+	}
+	if server, repo := getenv("GITHUB_SERVER_URL"), getenv("GITHUB_REPOSITORY"); server != "" && repo != "" && info.JobID != "" {
+		info.BuildURL = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, info.JobID)
+	}
+
+	if getenv("GITHUB_EVENT_NAME") == "pull_request" {
+		// GITHUB_SHA is the merge commit of pull requests,
+		// so the head of the pull request is read from the event.
+		var event struct {
+			Number      int `json:"number"`
+			PullRequest struct {
+				Head struct {
+					SHA string `json:"sha"`
+				} `json:"head"`
+			} `json:"pull_request"`
+		}
+		b, err := ioutil.ReadFile(getenv("GITHUB_EVENT_PATH"))
+		if err != nil {
+			return info, fmt.Errorf("cannot read GitHub event: %v", err)
+		}
+		if err := json.Unmarshal(b, &event); err != nil {
+			return info, fmt.Errorf("cannot parse GitHub event: %v", err)
+		}
+		info.PullRequest = strconv.Itoa(event.Number)
+		if sha := event.PullRequest.Head.SHA; sha != "" {
+			info.CommitSHA = sha
+			info.HeadRef = sha
+		}
+	}
+	return info, nil
+}
+
+// https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+type gitlabProvider struct{}
+
+func (gitlabProvider) Detect(getenv Getenv) bool {
+	return getenv("GITLAB_CI") == "true"
+}
+
+func (gitlabProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "gitlab",
+		JobID:       getenv("CI_PIPELINE_ID"),
+		// CI_EXTERNAL_PULL_REQUEST_IID is the pull request id from GitHub when building on GitLab
+		PullRequest: firstEnv(getenv, "CI_MERGE_REQUEST_IID", "CI_EXTERNAL_PULL_REQUEST_IID"),
+		Branch:      getenv("CI_COMMIT_REF_NAME"),
+		CommitSHA:   getenv("CI_COMMIT_SHA"),
+		BuildURL:    getenv("CI_PIPELINE_URL"),
+	}, nil
+}
+
+type werckerProvider struct{}
+
+func (werckerProvider) Detect(getenv Getenv) bool {
+	return getenv("WERCKER") == "true"
+}
+
+func (werckerProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "wercker",
+		JobID:       getenv("WERCKER_BUILD_ID"),
+		Branch:      getenv("WERCKER_GIT_BRANCH"),
+		CommitSHA:   getenv("WERCKER_GIT_COMMIT"),
+		BuildURL:    getenv("WERCKER_BUILD_URL"),
+	}, nil
+}
+
+// https://www.jetbrains.com/help/teamcity/predefined-build-parameters.html
+type teamCityProvider struct{}
+
+func (teamCityProvider) Detect(getenv Getenv) bool {
+	return getenv("TEAMCITY_VERSION") != ""
+}
+
+func (teamCityProvider) Info(getenv Getenv) (*CIInfo, error) {
+	return &CIInfo{
+		ServiceName: "teamcity",
+		JobID:       getenv("BUILD_NUMBER"),
+		PullRequest: getenv("PULL_REQUEST_NUMBER"),
+		Branch:      getenv("BRANCH_NAME"),
+		CommitSHA:   getenv("BUILD_VCS_NUMBER"),
+	}, nil
+}
+
+// genericProvider reads the generic CI variables documented by Coveralls.
+// It's used when no other provider detects the CI service.
+type genericProvider struct{}
+
+func (genericProvider) Detect(getenv Getenv) bool {
+	return true
+}
+
+func (genericProvider) Info(getenv Getenv) (*CIInfo, error) {
+	info := &CIInfo{
+		ServiceName: getenv("CI_NAME"),
+		JobID:       firstEnv(getenv, "CI_JOB_ID", "CI_BUILD_ID", "BUILD_NUMBER"),
+		JobNumber:   getenv("CI_BUILD_NUMBER"),
+		PullRequest: prNumber(firstEnv(getenv, "CI_PR_NUMBER", "PULL_REQUEST_NUMBER")),
+		Branch:      firstEnv(getenv, "CI_BRANCH", "BRANCH_NAME"),
+		CommitSHA:   getenv("CI_COMMIT_ID"),
+		BuildURL:    getenv("CI_BUILD_URL"),
+	}
+	if info.PullRequest == "" {
+		info.PullRequest = prNumberFromURL(getenv("CI_PULL_REQUEST"))
+	}
+	return info, nil
+}
@@ -0,0 +1,219 @@
+package coveralls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func mapEnv(m map[string]string) Getenv {
+	return func(key string) string {
+		return m[key]
+	}
+}
+
+func TestDetectCI(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls_ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eventPath := filepath.Join(dir, "event.json")
+	event := `{"number":12,"pull_request":{"head":{"sha":"0123abcd"}}}`
+	if err := ioutil.WriteFile(eventPath, []byte(event), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		testCase string
+		envs     map[string]string
+		want     CIInfo
+	}{
+		{
+			"Travis CI",
+			map[string]string{
+				"TRAVIS":               "true",
+				"TRAVIS_JOB_ID":        "1234",
+				"TRAVIS_JOB_NUMBER":    "56.1",
+				"TRAVIS_PULL_REQUEST":  "false",
+				"TRAVIS_BRANCH":        "travis-master",
+				"TRAVIS_COMMIT":        "abc",
+				"TRAVIS_BUILD_WEB_URL": "https://travis-ci.com/build/1",
+			},
+			CIInfo{
+				ServiceName: "travis-ci",
+				JobID:       "1234",
+				JobNumber:   "56.1",
+				Branch:      "travis-master",
+				CommitSHA:   "abc",
+				BuildURL:    "https://travis-ci.com/build/1",
+			},
+		},
+		{
+			"CircleCI pull request",
+			map[string]string{
+				"CIRCLECI":            "true",
+				"CIRCLE_BUILD_NUM":    "99",
+				"CIRCLE_PULL_REQUEST": "https://github.com/mattn/goveralls/pull/42",
+				"CIRCLE_BRANCH":       "circle-master",
+			},
+			CIInfo{ServiceName: "circleci", JobID: "99", PullRequest: "42", Branch: "circle-master"},
+		},
+		{
+			"CircleCI pull request from forked repo",
+			map[string]string{
+				"CIRCLECI":            "true",
+				"CIRCLE_PR_NUMBER":    "7",
+				"CIRCLE_PULL_REQUEST": "https://github.com/mattn/goveralls/pull/42",
+			},
+			CIInfo{ServiceName: "circleci", PullRequest: "7"},
+		},
+		{
+			"AppVeyor",
+			map[string]string{
+				"APPVEYOR":                     "True",
+				"APPVEYOR_JOB_ID":              "j1",
+				"APPVEYOR_PULL_REQUEST_NUMBER": "3",
+				"APPVEYOR_REPO_BRANCH":         "appveyor-master",
+			},
+			CIInfo{ServiceName: "appveyor", JobID: "j1", PullRequest: "3", Branch: "appveyor-master"},
+		},
+		{
+			"Jenkins multibranch",
+			map[string]string{
+				"JENKINS_URL":  "https://jenkins.example.com/",
+				"BUILD_NUMBER": "8",
+				"CHANGE_URL":   "https://github.com/mattn/goveralls/pull/5",
+				"BRANCH_NAME":  "PR-5",
+			},
+			CIInfo{ServiceName: "jenkins", JobID: "8", PullRequest: "5", Branch: "PR-5"},
+		},
+		{
+			"Buildkite without pull request",
+			map[string]string{
+				"BUILDKITE":              "true",
+				"BUILDKITE_BUILD_ID":     "b-1",
+				"BUILDKITE_PULL_REQUEST": "false",
+				"BUILDKITE_BRANCH":       "buildkite-master",
+			},
+			CIInfo{ServiceName: "buildkite", JobID: "b-1", Branch: "buildkite-master"},
+		},
+		{
+			"Drone",
+			map[string]string{
+				"DRONE":              "true",
+				"DRONE_BUILD_NUMBER": "4",
+				"DRONE_BRANCH":       "drone-master",
+			},
+			CIInfo{ServiceName: "drone", JobID: "4", Branch: "drone-master"},
+		},
+		{
+			"GitHub Actions push event",
+			map[string]string{
+				"GITHUB_ACTIONS":    "true",
+				"GITHUB_RUN_ID":     "777",
+				"GITHUB_REF":        "refs/heads/github-master",
+				"GITHUB_SHA":        "fff",
+				"GITHUB_EVENT_NAME": "push",
+				"GITHUB_SERVER_URL": "https://github.com",
+				"GITHUB_REPOSITORY": "mattn/goveralls",
+			},
+			CIInfo{
+				ServiceName: "github",
+				JobID:       "777",
+				Branch:      "github-master",
+				CommitSHA:   "fff",
+				BuildURL:    "https://github.com/mattn/goveralls/actions/runs/777",
+			},
+		},
+		{
+			"GitHub Actions pull request event",
+			map[string]string{
+				"GITHUB_ACTIONS":    "true",
+				"GITHUB_RUN_ID":     "777",
+				"GITHUB_HEAD_REF":   "feature",
+				"GITHUB_REF":        "refs/pull/12/merge",
+				"GITHUB_SHA":        "merge-commit",
+				"GITHUB_EVENT_NAME": "pull_request",
+				"GITHUB_EVENT_PATH": eventPath,
+			},
+			CIInfo{ServiceName: "github", JobID: "777", PullRequest: "12", Branch: "feature", CommitSHA: "0123abcd", HeadRef: "0123abcd"},
+		},
+		{
+			"GitLab merge request",
+			map[string]string{
+				"GITLAB_CI":            "true",
+				"CI_PIPELINE_ID":       "1000",
+				"CI_MERGE_REQUEST_IID": "9",
+				"CI_COMMIT_REF_NAME":   "gitlab-master",
+				"CI_COMMIT_SHA":        "ccc",
+			},
+			CIInfo{ServiceName: "gitlab", JobID: "1000", PullRequest: "9", Branch: "gitlab-master", CommitSHA: "ccc"},
+		},
+		{
+			"Codeship",
+			map[string]string{
+				"CI_NAME":      "codeship",
+				"CI_BUILD_ID":  "cs-1",
+				"CI_PR_NUMBER": "0",
+				"CI_BRANCH":    "ci-master",
+			},
+			CIInfo{ServiceName: "codeship", JobID: "cs-1", Branch: "ci-master"},
+		},
+		{
+			"TeamCity",
+			map[string]string{
+				"TEAMCITY_VERSION":    "2023.05",
+				"BUILD_NUMBER":        "10",
+				"PULL_REQUEST_NUMBER": "11",
+			},
+			CIInfo{ServiceName: "teamcity", JobID: "10", PullRequest: "11"},
+		},
+		{
+			"generic",
+			map[string]string{
+				"CI_NAME":         "my-ci",
+				"CI_JOB_ID":       "g-1",
+				"CI_BRANCH":       "ci-master",
+				"CI_PULL_REQUEST": "https://github.com/mattn/goveralls/pull/6",
+			},
+			CIInfo{ServiceName: "my-ci", JobID: "g-1", PullRequest: "6", Branch: "ci-master"},
+		},
+		{
+			"no CI",
+			map[string]string{},
+			CIInfo{},
+		},
+	}
+	for _, test := range tests {
+		got, err := DetectCI(mapEnv(test.envs))
+		if err != nil {
+			t.Errorf("%s: %v", test.testCase, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: DetectCI() = %#v, want %#v", test.testCase, *got, test.want)
+		}
+	}
+}
+
+func TestDetectCIGitHubEventError(t *testing.T) {
+	t.Parallel()
+
+	info, err := DetectCI(mapEnv(map[string]string{
+		"GITHUB_ACTIONS":    "true",
+		"GITHUB_RUN_ID":     "42",
+		"GITHUB_EVENT_NAME": "pull_request",
+		"GITHUB_EVENT_PATH": filepath.Join("testdata", "no-such-event.json"),
+	}))
+	if err == nil {
+		t.Error("expected an error for a missing event file")
+	}
+	if info == nil || info.JobID != "42" {
+		t.Errorf("expected the job ID along with the error, but got %#v", info)
+	}
+}
@@ -0,0 +1,349 @@
+package coveralls
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultEndpoint is the Coveralls.io server used by NewClient when no
+// endpoint is given.
+const DefaultEndpoint = "https://coveralls.io"
+
+// DefaultRetryWait is the wait before the first retry of a failed request
+// when Client.RetryWait isn't set.
+const DefaultRetryWait = time.Second
+
+// DefaultMaxRetryWait is the longest wait between retries when
+// Client.MaxRetryWait isn't set.
+const DefaultMaxRetryWait = 30 * time.Second
+
+// DefaultGzipThreshold is the size of the JSON encoded job above which it's
+// uploaded as a gzip compressed file.
+const DefaultGzipThreshold = 1 << 20
+
+// A Client submits coverage data to Coveralls.
+type Client struct {
+	// Endpoint is the base URL of the Coveralls server.
+	Endpoint string
+
+	// RepoToken is the repository token. It's sent with jobs that don't
+	// carry their own token, and with the parallel build webhook.
+	RepoToken string
+
+	// HTTPClient is used to send requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Logger receives debug output. If nil, nothing is logged.
+	Logger *log.Logger
+
+	// GzipThreshold is the size of the JSON encoded job in bytes above
+	// which it's sent as a gzip compressed multipart attachment instead
+	// of a form field. If it's zero, DefaultGzipThreshold is used. If it's
+	// negative, jobs are always compressed.
+	GzipThreshold int
+
+	// MaxRetries is the number of times a request is retried after a
+	// connection error, a 5xx or 429 response, or the maintenance page.
+	MaxRetries int
+
+	// RetryWait is the wait before the first retry. It's doubled on every
+	// retry up to MaxRetryWait, with random jitter. A Retry-After header
+	// of a 429 response takes precedence, up to MaxRetryWait too. If zero,
+	// DefaultRetryWait is used.
+	RetryWait time.Duration
+
+	// MaxRetryWait is the longest wait between retries. If zero,
+	// DefaultMaxRetryWait is used.
+	MaxRetryWait time.Duration
+}
+
+// NewClient returns a Client for the Coveralls server at endpoint.
+func NewClient(endpoint, repoToken string) *Client {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &Client{
+		Endpoint:  endpoint,
+		RepoToken: repoToken,
+	}
+}
+
+// An APIError is returned when Coveralls responds with an unexpected
+// status code.
+type APIError struct {
+	StatusCode int
+	Body       []byte
+
+	retryAfter time.Duration // wait requested by the Retry-After header
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("bad response status from coveralls: %d\n%s", e.StatusCode, e.Body)
+}
+
+// retryable reports whether the request may succeed if it's sent again.
+func (e *APIError) retryable() bool {
+	return e.ServerError() || e.Maintenance() || e.StatusCode == http.StatusTooManyRequests
+}
+
+// ServerError reports whether Coveralls failed internally.
+func (e *APIError) ServerError() bool {
+	return e.StatusCode >= http.StatusInternalServerError
+}
+
+// Maintenance reports whether Coveralls looks to be under maintenance.
+//
+// Coveralls serves the maintenance page as a static HTML hosting,
+// and the maintenance page doesn't accept POST method.
+// See https://github.com/mattn/goveralls/issues/204
+func (e *APIError) Maintenance() bool {
+	return e.StatusCode == http.StatusMethodNotAllowed
+}
+
+// SubmitJob posts the coverage data of a job to Coveralls.
+// If job has no repository token, c.RepoToken is used.
+func (c *Client) SubmitJob(ctx context.Context, job *Job) (*Response, error) {
+	j := *job
+	if j.RepoToken == nil && c.RepoToken != "" {
+		j.RepoToken = &c.RepoToken
+	}
+
+	if c.Logger != nil {
+		j := j
+		if j.RepoToken != nil && *j.RepoToken != "" {
+			s := "*******"
+			j.RepoToken = &s
+		}
+		b, err := json.MarshalIndent(j, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		c.Logger.Printf("Posting data: %s", b)
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := c.GzipThreshold
+	if threshold == 0 {
+		threshold = DefaultGzipThreshold
+	}
+	var bodyBytes []byte
+	if len(b) > threshold {
+		bodyBytes, err = c.postGzip(ctx, "/api/v1/jobs", "json_file", b)
+	} else {
+		params := make(url.Values)
+		params.Set("json", string(b))
+		bodyBytes, err = c.postForm(ctx, "/api/v1/jobs", params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response Response
+	if err = json.Unmarshal(bodyBytes, &response); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal response JSON from coveralls: %s\n%s", err, bodyBytes)
+	}
+	if response.Error {
+		return &response, errors.New(response.Message)
+	}
+	return &response, nil
+}
+
+// FinishParallel notifies Coveralls that all jobs of the parallel build
+// buildNum are completed. repoName may be empty.
+// ref. https://docs.coveralls.io/parallel-build-webhook
+func (c *Client) FinishParallel(ctx context.Context, buildNum, repoName string) (*WebHookResponse, error) {
+	params := make(url.Values)
+	params.Set("repo_token", c.RepoToken)
+	if repoName != "" {
+		params.Set("repo_name", repoName)
+	}
+	params.Set("payload[build_num]", buildNum)
+	params.Set("payload[status]", "done")
+
+	if c.Logger != nil {
+		logged := make(url.Values)
+		for k, v := range params {
+			logged[k] = v
+		}
+		if c.RepoToken != "" {
+			logged.Set("repo_token", "*******")
+		}
+		c.Logger.Printf("Posting webhook data: %q", logged.Encode())
+	}
+
+	bodyBytes, err := c.postForm(ctx, "/webhook", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var response WebHookResponse
+	if err = json.Unmarshal(bodyBytes, &response); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal response JSON from coveralls: %s\n%s", err, bodyBytes)
+	}
+	response.Body = bodyBytes
+	return &response, nil
+}
+
+// postForm posts params to path as a URL encoded form.
+func (c *Client) postForm(ctx context.Context, path string, params url.Values) ([]byte, error) {
+	return c.post(ctx, path, "application/x-www-form-urlencoded", []byte(params.Encode()))
+}
+
+// postGzip posts data to path as a gzip compressed attachment of a
+// multipart form.
+func (c *Client) postGzip(ctx context.Context, path, field string, data []byte) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, field))
+	h.Set("Content-Type", "gzip/json")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(part)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if c.Logger != nil {
+		c.Logger.Printf("Compressed %d bytes of data to %d bytes", len(data), body.Len())
+	}
+	return c.post(ctx, path, w.FormDataContentType(), body.Bytes())
+}
+
+// post posts body to path and returns the response body. A response
+// status other than 200 is reported as an *APIError. Failed requests are
+// retried as configured by c.MaxRetries.
+func (c *Client) post(ctx context.Context, path, contentType string, body []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		bodyBytes, err := c.postOnce(ctx, path, contentType, body)
+		if err == nil {
+			return bodyBytes, nil
+		}
+		if attempt >= c.MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		var apiErr *APIError
+		isAPIErr := errors.As(err, &apiErr)
+		if isAPIErr && !apiErr.retryable() {
+			return nil, err
+		}
+		wait := c.retryWait(attempt)
+		if isAPIErr && apiErr.retryAfter > 0 {
+			wait = apiErr.retryAfter
+			if maxWait := c.maxRetryWait(); wait > maxWait {
+				wait = maxWait
+			}
+		}
+		if c.Logger != nil {
+			c.Logger.Printf("Attempt %d/%d to post %s failed: %v; retrying in %v", attempt+1, c.MaxRetries+1, path, err, wait)
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// retryWait returns the exponential backoff with jitter before the retry
+// following attempt.
+func (c *Client) retryWait(attempt int) time.Duration {
+	wait, maxWait := c.RetryWait, c.maxRetryWait()
+	if wait <= 0 {
+		wait = DefaultRetryWait
+	}
+	for i := 0; i < attempt && wait < maxWait; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	// wait between the half and the full backoff
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// maxRetryWait returns the longest wait between retries.
+func (c *Client) maxRetryWait() time.Duration {
+	if c.MaxRetryWait <= 0 {
+		return DefaultMaxRetryWait
+	}
+	return c.MaxRetryWait
+}
+
+// postOnce sends a single request of post.
+func (c *Client) postOnce(ctx context.Context, path, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body from coveralls: %s", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &APIError{
+			StatusCode: res.StatusCode,
+			Body:       bodyBytes,
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	return bodyBytes, nil
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// seconds or an HTTP date.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(s); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,308 @@
+package coveralls
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitJob(t *testing.T) {
+	t.Parallel()
+
+	var got Job
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/jobs" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if err := json.Unmarshal([]byte(r.FormValue("json")), &got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, `{"error":false,"message":"Job #1.1","url":"http://fake.url"}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "secret")
+	res, err := c.SubmitJob(context.Background(), &Job{ServiceJobID: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Message != "Job #1.1" || res.URL != "http://fake.url" {
+		t.Errorf("unexpected response: %#v", res)
+	}
+	if got.ServiceJobID != "42" {
+		t.Errorf("expected job id 42, but got %q", got.ServiceJobID)
+	}
+	if got.RepoToken == nil || *got.RepoToken != "secret" {
+		t.Errorf("expected the client's repo token to be sent, but got %v", got.RepoToken)
+	}
+}
+
+func TestSubmitJobErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status      int
+		body        string
+		serverError bool
+		maintenance bool
+	}{
+		{status: http.StatusOK, body: `{"error":true,"message":"Couldn't find a repository"}`},
+		{status: http.StatusBadGateway, body: "bad gateway", serverError: true},
+		{status: http.StatusMethodNotAllowed, body: "maintenance", maintenance: true},
+		{status: http.StatusUnprocessableEntity, body: `{"message":"invalid"}`},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+
+		_, err := NewClient(ts.URL, "").SubmitJob(context.Background(), &Job{})
+		ts.Close()
+		if err == nil {
+			t.Errorf("status %d: expected an error", tt.status)
+			continue
+		}
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			if tt.status != http.StatusOK {
+				t.Errorf("status %d: expected *APIError, but got %T", tt.status, err)
+			}
+			continue
+		}
+		if apiErr.StatusCode != tt.status {
+			t.Errorf("expected status %d, but got %d", tt.status, apiErr.StatusCode)
+		}
+		if apiErr.ServerError() != tt.serverError {
+			t.Errorf("status %d: ServerError() = %v", tt.status, apiErr.ServerError())
+		}
+		if apiErr.Maintenance() != tt.maintenance {
+			t.Errorf("status %d: Maintenance() = %v", tt.status, apiErr.Maintenance())
+		}
+	}
+}
+
+func TestFinishParallel(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/webhook" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		want := map[string]string{
+			"repo_token":         "secret",
+			"repo_name":          "mattn/goveralls",
+			"payload[build_num]": "123",
+			"payload[status]":    "done",
+		}
+		for k, v := range want {
+			if got := r.FormValue(k); got != v {
+				t.Errorf("expected %s=%q, but got %q", k, v, got)
+			}
+		}
+		fmt.Fprintln(w, `{"done":true}`)
+	}))
+	defer ts.Close()
+
+	res, err := NewClient(ts.URL, "secret").FinishParallel(context.Background(), "123", "mattn/goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Done {
+		t.Error("expected the build to be done")
+	}
+}
+
+func TestFinishParallelNotDone(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"done":false,"error":"No build matching CI build number 123 found"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, body)
+	}))
+	defer ts.Close()
+
+	res, err := NewClient(ts.URL, "secret").FinishParallel(context.Background(), "123", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Done {
+		t.Error("expected the build not to be done")
+	}
+	if got := strings.TrimSpace(string(res.Body)); got != body {
+		t.Errorf("expected the body of the response, but got %q", got)
+	}
+}
+
+func TestSubmitJobGzip(t *testing.T) {
+	t.Parallel()
+
+	var got Job
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, h, err := r.FormFile("json_file")
+		if err != nil {
+			t.Errorf("expected a json_file attachment: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		if ct := h.Header.Get("Content-Type"); ct != "gzip/json" {
+			t.Errorf("unexpected content type %q", ct)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Errorf("expected gzip compressed data: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(zr).Decode(&got); err != nil {
+			t.Errorf("unexpected JSON: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, `{"error":false,"message":"Job #1.1","url":"http://fake.url"}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "")
+	c.GzipThreshold = 10
+	job := &Job{
+		ServiceJobID: "42",
+		SourceFiles: []*SourceFile{
+			{Name: "foo.go", Coverage: []interface{}{nil, 1}},
+		},
+	}
+	if _, err := c.SubmitJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if got.ServiceJobID != "42" || len(got.SourceFiles) != 1 || got.SourceFiles[0].Name != "foo.go" {
+		t.Errorf("unexpected job: %#v", got)
+	}
+}
+
+func TestSubmitJobRetry(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	var payloads []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		payloads = append(payloads, r.FormValue("json"))
+		mu.Unlock()
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 3:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			fmt.Fprintln(w, `{"error":false,"message":"Job #1.1","url":"http://fake.url"}`)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "")
+	c.MaxRetries = 3
+	c.RetryWait = time.Millisecond
+	if _, err := c.SubmitJob(context.Background(), &Job{ServiceJobID: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 4 {
+		t.Errorf("expected 4 attempts, but got %d", attempts)
+	}
+	for _, p := range payloads[1:] {
+		if p != payloads[0] {
+			t.Errorf("expected the same payload on retries, but got %q and %q", payloads[0], p)
+		}
+	}
+}
+
+func TestSubmitJobRetryAfterLimit(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintln(w, `{"error":false,"message":"Job #1.1","url":"http://fake.url"}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, "")
+	c.MaxRetries = 1
+	c.MaxRetryWait = 10 * time.Millisecond
+	// the wait of a day is cut to MaxRetryWait
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.SubmitJob(ctx, &Job{}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, but got %d", attempts)
+	}
+}
+
+func TestSubmitJobRetryGiveUp(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status   int
+		retries  int
+		attempts int32
+	}{
+		{status: http.StatusServiceUnavailable, retries: 2, attempts: 3},
+		{status: http.StatusUnprocessableEntity, retries: 2, attempts: 1},
+		{status: http.StatusInternalServerError, retries: 0, attempts: 1},
+	}
+	for _, tt := range tests {
+		var attempts int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(tt.status)
+		}))
+
+		c := NewClient(ts.URL, "")
+		c.MaxRetries = tt.retries
+		c.RetryWait = time.Millisecond
+		_, err := c.SubmitJob(context.Background(), &Job{})
+		ts.Close()
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+			t.Errorf("status %d: expected *APIError, but got %v", tt.status, err)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("status %d: expected %d attempts, but got %d", tt.status, tt.attempts, attempts)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Errorf("expected 2m, but got %v", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d <= 59*time.Minute {
+		t.Errorf("expected about 1h, but got %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("expected 0, but got %v", d)
+	}
+}
@@ -0,0 +1,62 @@
+// Package coveralls implements a client for the Coveralls.io API.
+//
+// See https://docs.coveralls.io/api-reference for the details of the API.
+package coveralls
+
+import (
+	"time"
+)
+
+// A SourceFile represents a source code file and its coverage data for a
+// single job.
+type SourceFile struct {
+	Name         string        `json:"name"`                    // File path of this source file
+	Source       string        `json:"source,omitempty"`        // Full source code of this file
+	SourceDigest string        `json:"source_digest,omitempty"` // MD5 digest of the full source code of this file
+	Coverage     []interface{} `json:"coverage"`                // Requires both nulls and integers
+	Branches     []int         `json:"branches,omitempty"`      // Flat list of [line, block, branch, hits]
+}
+
+// A Job represents the coverage data from a single run of a test suite.
+type Job struct {
+	RepoToken          *string       `json:"repo_token,omitempty"`
+	ServiceJobID       string        `json:"service_job_id"`
+	ServiceJobNumber   string        `json:"service_job_number,omitempty"`
+	ServicePullRequest string        `json:"service_pull_request,omitempty"`
+	ServiceName        string        `json:"service_name"`
+	ServiceBuildURL    string        `json:"service_build_url,omitempty"`
+	FlagName           string        `json:"flag_name,omitempty"`
+	SourceFiles        []*SourceFile `json:"source_files"`
+	Parallel           *bool         `json:"parallel,omitempty"`
+	Git                *Git          `json:"git,omitempty"`
+	RunAt              time.Time     `json:"run_at"`
+}
+
+// A Head object encapsulates information about the HEAD revision of a git repo.
+type Head struct {
+	ID             string `json:"id"`
+	AuthorName     string `json:"author_name,omitempty"`
+	AuthorEmail    string `json:"author_email,omitempty"`
+	CommitterName  string `json:"committer_name,omitempty"`
+	CommitterEmail string `json:"committer_email,omitempty"`
+	Message        string `json:"message"`
+}
+
+// A Git object encapsulates information about a git repo.
+type Git struct {
+	Head   Head   `json:"head"`
+	Branch string `json:"branch"`
+}
+
+// A Response is returned by the Coveralls.io API.
+type Response struct {
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Error   bool   `json:"error"`
+}
+
+// A WebHookResponse is returned by the Coveralls.io WebHook.
+type WebHookResponse struct {
+	Done bool   `json:"done"`
+	Body []byte `json:"-"` // raw body of the response
+}
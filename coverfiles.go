@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// findProfiles returns the coverage files given by the comma separated list
+// of -coverprofile or -coverimport. An entry is either "-" for the standard
+// input, a file, a directory scanned recursively for the files accepted by
+// accept, or a glob pattern in which "**" matches any number of directories.
+func findProfiles(list string, accept func(fn string) bool) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(fn string) {
+		if !seen[fn] {
+			seen[fn] = true
+			files = append(files, fn)
+		}
+	}
+	for _, entry := range strings.Split(list, ",") {
+		switch {
+		case entry == "-":
+			add(entry)
+		case strings.ContainsAny(entry, "*?["):
+			matches, err := globProfiles(entry)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", entry)
+			}
+			for _, fn := range matches {
+				add(fn)
+			}
+		default:
+			fi, err := os.Stat(entry)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				add(entry)
+				continue
+			}
+			found, err := scanProfiles(entry, accept)
+			if err != nil {
+				return nil, err
+			}
+			if len(found) == 0 {
+				return nil, fmt.Errorf("no coverage files in %q", entry)
+			}
+			for _, fn := range found {
+				add(fn)
+			}
+		}
+	}
+	return files, nil
+}
+
+// globProfiles returns the files matching pattern. "**" matches any number
+// of directories; the other wildcards are the ones of filepath.Match.
+func globProfiles(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+
+	// walk the directories before the first wildcard only
+	pat := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(pat)-1 && !strings.ContainsAny(pat[i], "*?[") {
+		i++
+	}
+	root := strings.Join(pat[:i], "/")
+	if root == "" {
+		root = "."
+		if filepath.IsAbs(pattern) {
+			root = "/"
+		}
+	}
+
+	var matches []string
+	err := filepath.Walk(filepath.FromSlash(root), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// the paths walked from "." have no leading "./", like the cleaned pattern
+		if matchSegments(pat, strings.Split(filepath.ToSlash(p), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchSegments reports whether the path segments of name match the
+// segments of a pattern, where "**" matches any number of segments.
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// scanProfiles returns the files in dir and its subdirectories accepted by
+// accept. Hidden directories are skipped.
+func scanProfiles(dir string, accept func(fn string) bool) ([]string, error) {
+	var found []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if accept(p) {
+			found = append(found, p)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// isProfile reports whether the file fn looks like a profile, starting with
+// a "mode:" line.
+func isProfile(fn string) bool {
+	r, err := openProfile(fn)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	return strings.HasPrefix(line, "mode: ")
+}
+
+// openProfile opens the coverage file fn, which is decompressed if its name
+// ends with ".gz". If fn is "-", the standard input is read.
+func openProfile(fn string) (io.ReadCloser, error) {
+	if fn == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(fn, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// readProfile parses the profile file fn opened by openProfile.
+func readProfile(fn string) ([]*cover.Profile, error) {
+	r, err := openProfile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return cover.ParseProfilesFromReader(r)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindProfiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const prof = "mode: set\nexample.com/p/p.go:3.14,5.2 1 1\n"
+	writeFiles(t, dir, map[string]string{
+		"artifacts/a/coverage-unit.out":   prof,
+		"artifacts/a/b/coverage-e2e.out":  prof,
+		"artifacts/coverage.out":          prof,
+		"artifacts/a/notes.txt":           "not a profile\n",
+		"artifacts/.cache/coverage-x.out": prof,
+		"other/cover.out":                 prof,
+	})
+
+	p := func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{
+			p("other/cover.out"),
+			[]string{p("other/cover.out")},
+		},
+		{
+			p("artifacts/**/coverage*.out"),
+			[]string{
+				p("artifacts/.cache/coverage-x.out"),
+				p("artifacts/a/b/coverage-e2e.out"),
+				p("artifacts/a/coverage-unit.out"),
+				p("artifacts/coverage.out"),
+			},
+		},
+		{
+			p("artifacts/*/coverage*.out") + "," + p("artifacts/a/coverage-unit.out") + ",-",
+			[]string{p("artifacts/.cache/coverage-x.out"), p("artifacts/a/coverage-unit.out"), "-"},
+		},
+		{
+			p("artifacts"),
+			[]string{
+				p("artifacts/a/b/coverage-e2e.out"),
+				p("artifacts/a/coverage-unit.out"),
+				p("artifacts/coverage.out"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := findProfiles(tt.list, isProfile)
+		if err != nil {
+			t.Errorf("findProfiles(%q): %v", tt.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findProfiles(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+
+	// a relative pattern with a wildcard in its first segment is walked from "."
+	rel, err := ioutil.TempDir(".", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rel)
+	writeFiles(t, rel, map[string]string{"art1/sub/c.out": prof})
+	list := rel + "*/**/c.out"
+	got, err := findProfiles(list, isProfile)
+	if want := []string{filepath.Join(rel, "art1", "sub", "c.out")}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("findProfiles(%q) = %v, %v, want %v", list, got, err, want)
+	}
+
+	for _, list := range []string{p("artifacts/**/*.cov"), p("other/missing.out"), p("artifacts/a/b/c")} {
+		if _, err := findProfiles(list, isProfile); err == nil {
+			t.Errorf("findProfiles(%q) should fail", list)
+		}
+	}
+}
+
+func TestReadProfileGzip(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("mode: count\nexample.com/p/p.go:3.14,5.2 1 4\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "coverage.out.gz")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isProfile(fn) {
+		t.Errorf("%s should be detected as a profile", fn)
+	}
+	profs, err := readProfile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profs) != 1 || profs[0].Mode != "count" || len(profs[0].Blocks) != 1 || profs[0].Blocks[0].Count != 4 {
+		t.Errorf("unexpected profiles: %v", profs)
+	}
+}
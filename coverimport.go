@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An importedFile is the coverage of a source file read from the report
+// of another tool.
+type importedFile struct {
+	name     string           // file name in the report
+	lines    map[int]int      // hits by line
+	branches map[[3]int]int   // hits by line, block and branch
+	stmts    []gocovStatement // statements given by their offsets, see addStatements
+}
+
+func newImportedFile(name string) *importedFile {
+	return &importedFile{
+		name:     name,
+		lines:    make(map[int]int),
+		branches: make(map[[3]int]int),
+	}
+}
+
+// addStatements sets the hits of the lines starting the statements given by
+// their byte offsets in the source src. A line keeps the most hits of the
+// statements starting on it.
+func (f *importedFile) addStatements(src []byte) {
+	for _, st := range f.stmts {
+		if st.Start < 0 || st.Start > len(src) {
+			continue
+		}
+		line := bytes.Count(src[:st.Start], []byte("\n")) + 1
+		if hits, ok := f.lines[line]; !ok || st.Reached > hits {
+			f.lines[line] = st.Reached
+		}
+	}
+}
+
+// coverage returns the hits of the lines in the form of SourceFile.Coverage,
+// with nil for the lines not in the report.
+func (f *importedFile) coverage() []interface{} {
+	maxLineNo := 0
+	for line := range f.lines {
+		if line > maxLineNo {
+			maxLineNo = line
+		}
+	}
+	cov := make([]interface{}, maxLineNo)
+	for line, hits := range f.lines {
+		if line > 0 {
+			cov[line-1] = hits
+		}
+	}
+	return cov
+}
+
+// branchList returns the hits of the branches in the form of
+// SourceFile.Branches.
+func (f *importedFile) branchList() []int {
+	keys := make([][3]int, 0, len(f.branches))
+	for k := range f.branches {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for n := range keys[i] {
+			if keys[i][n] != keys[j][n] {
+				return keys[i][n] < keys[j][n]
+			}
+		}
+		return false
+	})
+	var rv []int
+	for _, k := range keys {
+		rv = append(rv, k[0], k[1], k[2], f.branches[k])
+	}
+	return rv
+}
+
+// reportFormat returns the format of the coverage report starting with
+// head: "lcov", "cobertura" or "gocov", or "" if it is none of them.
+func reportFormat(head []byte) string {
+	head = bytes.TrimSpace(head)
+	switch {
+	case bytes.HasPrefix(head, []byte("TN:")) || bytes.HasPrefix(head, []byte("SF:")):
+		return "lcov"
+	case bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<coverage")):
+		return "cobertura"
+	case bytes.HasPrefix(head, []byte("{")) && bytes.Contains(head, []byte(`"Packages"`)):
+		return "gocov"
+	}
+	return ""
+}
+
+// isReport reports whether the file fn looks like a coverage report known
+// by reportFormat.
+func isReport(fn string) bool {
+	r, err := openProfile(fn)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(r, head)
+	return reportFormat(head[:n]) != ""
+}
+
+// parseLCOV parses an LCOV tracefile. The records of a file, like the ones
+// of several tests, are added up.
+func parseLCOV(r io.Reader) ([]*importedFile, error) {
+	var files []*importedFile
+	index := make(map[string]*importedFile)
+	var cur *importedFile
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			if line == "end_of_record" {
+				cur = nil
+			}
+			continue
+		}
+		key, value := line[:i], line[i+1:]
+		switch key {
+		case "SF":
+			cur = index[value]
+			if cur == nil {
+				cur = newImportedFile(value)
+				index[value] = cur
+				files = append(files, cur)
+			}
+		case "DA":
+			fields := strings.Split(value, ",")
+			if cur == nil || len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: bad DA record %q", n, value)
+			}
+			lineNo, err1 := strconv.Atoi(fields[0])
+			hits, err2 := strconv.Atoi(fields[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("line %d: bad DA record %q", n, value)
+			}
+			cur.lines[lineNo] += hits
+		case "BRDA":
+			fields := strings.Split(value, ",")
+			if cur == nil || len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: bad BRDA record %q", n, value)
+			}
+			// "-" means that the branch was never evaluated
+			if fields[3] == "-" {
+				fields[3] = "0"
+			}
+			var k [3]int
+			var hits int
+			var err error
+			for j, f := range fields {
+				if j < 3 {
+					k[j], err = strconv.Atoi(f)
+				} else {
+					hits, err = strconv.Atoi(f)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad BRDA record %q", n, value)
+				}
+			}
+			cur.branches[k] += hits
+		}
+	}
+	return files, s.Err()
+}
+
+// coberturaReport is the part of a Cobertura XML report read by
+// parseCobertura.
+type coberturaReport struct {
+	Sources  []string `xml:"sources>source"`
+	Packages []struct {
+		Classes []struct {
+			Filename string `xml:"filename,attr"`
+			Lines    []struct {
+				Number            int    `xml:"number,attr"`
+				Hits              int    `xml:"hits,attr"`
+				Branch            bool   `xml:"branch,attr"`
+				ConditionCoverage string `xml:"condition-coverage,attr"`
+			} `xml:"lines>line"`
+		} `xml:"classes>class"`
+	} `xml:"packages>package"`
+}
+
+// conditionCoverageRe matches the branches taken and all branches of the
+// condition-coverage of a Cobertura line, like "50% (1/2)".
+var conditionCoverageRe = regexp.MustCompile(`\((\d+)/(\d+)\)`)
+
+// parseCobertura parses a Cobertura XML report and returns its files and
+// the source directories their names are relative to. The hits of a line in
+// several classes of a file are added up, like the records of LCOV. The
+// branches of a line are only known to be taken or not, so a taken branch
+// counts one hit.
+func parseCobertura(r io.Reader) ([]*importedFile, []string, error) {
+	var report coberturaReport
+	if err := xml.NewDecoder(r).Decode(&report); err != nil {
+		return nil, nil, err
+	}
+	var files []*importedFile
+	index := make(map[string]*importedFile)
+	for _, pkg := range report.Packages {
+		for _, class := range pkg.Classes {
+			f := index[class.Filename]
+			if f == nil {
+				f = newImportedFile(class.Filename)
+				index[class.Filename] = f
+				files = append(files, f)
+			}
+			for _, line := range class.Lines {
+				f.lines[line.Number] += line.Hits
+				if !line.Branch {
+					continue
+				}
+				m := conditionCoverageRe.FindStringSubmatch(line.ConditionCoverage)
+				if m == nil {
+					continue
+				}
+				taken, _ := strconv.Atoi(m[1])
+				total, _ := strconv.Atoi(m[2])
+				for i := 0; i < total; i++ {
+					var hits int
+					if i < taken {
+						hits = 1
+					}
+					f.branches[[3]int{line.Number, 0, i}] += hits
+				}
+			}
+		}
+	}
+	var sources []string
+	for _, src := range report.Sources {
+		if src = strings.TrimSpace(src); src != "" {
+			sources = append(sources, src)
+		}
+	}
+	return files, sources, nil
+}
+
+// gocovReport is the JSON report of gocov.
+type gocovReport struct {
+	Packages []struct {
+		Name      string
+		Functions []struct {
+			Name       string
+			File       string
+			Statements []gocovStatement
+		}
+	}
+}
+
+// A gocovStatement is a statement of a gocov report, given by its byte
+// offsets in the file.
+type gocovStatement struct {
+	Start, End int
+	Reached    int
+}
+
+// parseGocov parses a gocov JSON report. Its statements are given by byte
+// offsets, which are mapped to lines by importedFile.addStatements once the
+// source is read.
+func parseGocov(r io.Reader) ([]*importedFile, error) {
+	var report gocovReport
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, err
+	}
+	var files []*importedFile
+	index := make(map[string]*importedFile)
+	for _, pkg := range report.Packages {
+		for _, fn := range pkg.Functions {
+			f := index[fn.File]
+			if f == nil {
+				f = newImportedFile(fn.File)
+				index[fn.File] = f
+				files = append(files, f)
+			}
+			f.stmts = append(f.stmts, fn.Statements...)
+		}
+	}
+	return files, nil
+}
+
+// findImportedFile returns the local path of the file name of a coverage
+// report. The name may be absolute, relative to the current directory or
+// to one of the source directories of the report, or an import path. Names
+// of other machines are matched by their longest suffix found in the
+// repository.
+func findImportedFile(mods []goModule, name string, sources []string) (string, error) {
+	name = filepath.FromSlash(name)
+	var cands []string
+	if filepath.IsAbs(name) {
+		cands = append(cands, name)
+	} else {
+		cands = append(cands, name)
+		for _, src := range sources {
+			cands = append(cands, filepath.Join(filepath.FromSlash(src), name))
+		}
+	}
+	for _, c := range cands {
+		if isFile(c) {
+			return filepath.Abs(c)
+		}
+	}
+	if !filepath.IsAbs(name) {
+		if path, err := findFile(mods, filepath.ToSlash(name)); err == nil && isFile(path) {
+			return path, nil
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root, ok := findRepositoryRoot(wd)
+	if !ok {
+		root = wd
+	}
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i := 1; i < len(parts); i++ {
+		path := filepath.Join(root, filepath.Join(parts[i:]...))
+		if isFile(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find file %q", name)
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// importCoverage reads the LCOV, Cobertura and gocov reports given by the
+// comma separated list of -coverimport, as found by findProfiles, and
+// returns their merged source files.
+func importCoverage(list string) ([]*SourceFile, error) {
+	files, err := findProfiles(list, isReport)
+	if err != nil {
+		return nil, fmt.Errorf("error finding coverage reports: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	mods, err := findModules(wd, *multiModule)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find modules: %v", err)
+	}
+
+	var rv []*SourceFile
+	for _, fn := range files {
+		if fn == "-" {
+			fmt.Println("goveralls: importing report from stdin")
+		} else {
+			fmt.Println("goveralls: importing report", fn)
+		}
+		r, err := openProfile(fn)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var imported []*importedFile
+		var sources []string
+		switch format := reportFormat(b); format {
+		case "lcov":
+			imported, err = parseLCOV(bytes.NewReader(b))
+		case "cobertura":
+			imported, sources, err = parseCobertura(bytes.NewReader(b))
+		case "gocov":
+			imported, err = parseGocov(bytes.NewReader(b))
+		default:
+			return nil, fmt.Errorf("unknown format of coverage report %s", fn)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing coverage report %s: %v", fn, err)
+		}
+
+		var sfs []*SourceFile
+		for _, f := range imported {
+			path, err := findImportedFile(mods, f.name, sources)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fn, err)
+			}
+			sf, fb, err := readSourceFile(path)
+			if err != nil {
+				return nil, err
+			}
+			f.addStatements(fb)
+			sf.Coverage = f.coverage()
+			if *branches {
+				sf.Branches = f.branchList()
+			}
+			sfs = append(sfs, sf)
+		}
+		rv = mergeSourceFiles(rv, sfs)
+	}
+	return rv, nil
+}
+
+// mergeSourceFiles adds the source files of b to a. The hits of the lines
+// and branches of a file in both are added up; a line in neither stays nil.
+func mergeSourceFiles(a, b []*SourceFile) []*SourceFile {
+	index := make(map[string]*SourceFile)
+	for _, sf := range a {
+		index[sf.Name] = sf
+	}
+	for _, sf := range b {
+		dst, ok := index[sf.Name]
+		if !ok {
+			index[sf.Name] = sf
+			a = append(a, sf)
+			continue
+		}
+		for len(dst.Coverage) < len(sf.Coverage) {
+			dst.Coverage = append(dst.Coverage, nil)
+		}
+		for i, c := range sf.Coverage {
+			hits, ok := c.(int)
+			if !ok {
+				continue
+			}
+			if old, ok := dst.Coverage[i].(int); ok {
+				hits += old
+			}
+			dst.Coverage[i] = hits
+		}
+		dst.Branches = mergeBranches(dst.Branches, sf.Branches)
+	}
+	return a
+}
+
+// mergeBranches adds the hits of the branches b, in the form of
+// SourceFile.Branches, to a.
+func mergeBranches(a, b []int) []int {
+	if len(b) == 0 {
+		return a
+	}
+	f := &importedFile{branches: make(map[[3]int]int)}
+	for _, br := range [][]int{a, b} {
+		for i := 0; i+3 < len(br); i += 4 {
+			f.branches[[3]int{br[i], br[i+1], br[i+2]}] += br[i+3]
+		}
+	}
+	return f.branchList()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLCOV(t *testing.T) {
+	t.Parallel()
+
+	const report = `TN:unit
+SF:pkg/a.go
+DA:3,1
+DA:4,0
+BRDA:4,0,0,1
+BRDA:4,0,1,-
+end_of_record
+TN:e2e
+SF:pkg/a.go
+DA:4,2,abcdef
+BRDA:4,0,1,2
+end_of_record
+SF:pkg/b.go
+DA:7,5
+end_of_record
+`
+	files, err := parseLCOV(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].name != "pkg/a.go" || files[1].name != "pkg/b.go" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	if want := map[int]int{3: 1, 4: 2}; !reflect.DeepEqual(files[0].lines, want) {
+		t.Errorf("lines = %v, want %v", files[0].lines, want)
+	}
+	if got, want := files[0].branchList(), []int{4, 0, 0, 1, 4, 0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("branches = %v, want %v", got, want)
+	}
+	if got, want := files[1].coverage(), []interface{}{nil, nil, nil, nil, nil, nil, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("coverage = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"DA:1,1\n", "SF:a.go\nDA:x,1\n", "SF:a.go\nBRDA:1,0,1\n"} {
+		if _, err := parseLCOV(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseLCOV(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseCobertura(t *testing.T) {
+	t.Parallel()
+
+	const report = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">
+<coverage line-rate="0.5" branch-rate="0" version="" timestamp="0">
+	<sources>
+		<source>/src/example.com/p</source>
+	</sources>
+	<packages>
+		<package name="example.com/p" line-rate="0.5" branch-rate="0" complexity="0">
+			<classes>
+				<class name="-" filename="p.go" line-rate="0.5" branch-rate="0" complexity="0">
+					<methods>
+						<method name="F" signature="" line-rate="1" branch-rate="0" complexity="0">
+							<lines><line number="4" hits="3"></line></lines>
+						</method>
+					</methods>
+					<lines>
+						<line number="4" hits="3" branch="true" condition-coverage="50% (1/2)"></line>
+						<line number="5" hits="0"></line>
+					</lines>
+				</class>
+				<class name="T" filename="p.go" line-rate="1" branch-rate="0" complexity="0">
+					<lines><line number="4" hits="2"></line><line number="5" hits="1"></line></lines>
+				</class>
+			</classes>
+		</package>
+	</packages>
+</coverage>
+`
+	if got := reportFormat([]byte(report)); got != "cobertura" {
+		t.Fatalf("reportFormat() = %q, want cobertura", got)
+	}
+	files, sources, err := parseCobertura(strings.NewReader(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sources, []string{"/src/example.com/p"}) {
+		t.Errorf("sources = %v", sources)
+	}
+	if len(files) != 1 || files[0].name != "p.go" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	// the hits of a line in several classes are added up
+	if want := map[int]int{4: 5, 5: 1}; !reflect.DeepEqual(files[0].lines, want) {
+		t.Errorf("lines = %v, want %v", files[0].lines, want)
+	}
+	if want := []int{4, 0, 0, 1, 4, 0, 1, 0}; !reflect.DeepEqual(files[0].branchList(), want) {
+		t.Errorf("branches = %v, want %v", files[0].branchList(), want)
+	}
+}
+
+func TestParseGocov(t *testing.T) {
+	t.Parallel()
+
+	b, err := ioutil.ReadFile("tester/cov.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reportFormat(b); got != "gocov" {
+		t.Fatalf("reportFormat() = %q, want gocov", got)
+	}
+	files, err := parseGocov(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0].name, "/tester/tester.go") || len(files[0].stmts) != 4 {
+		t.Fatalf("unexpected files: %v", files)
+	}
+
+	// the offsets of the report match tester/tester.go
+	src, err := ioutil.ReadFile("tester/tester.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files[0].addStatements(src)
+	if want := map[int]int{8: 1, 9: 1, 10: 1, 12: 1}; !reflect.DeepEqual(files[0].lines, want) {
+		t.Errorf("lines = %v, want %v", files[0].lines, want)
+	}
+}
+
+func TestImportCoverage(t *testing.T) {
+	t.Parallel()
+
+	// the report names the file on another machine
+	sfs, err := importCoverage("tester/cov.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sfs) != 1 || sfs[0].Name != "tester/tester.go" {
+		t.Fatalf("unexpected source files: %v", sfs)
+	}
+	want := []interface{}{nil, nil, nil, nil, nil, nil, nil, 1, 1, 1, nil, 1}
+	if !reflect.DeepEqual(sfs[0].Coverage, want) {
+		t.Errorf("coverage = %v, want %v", sfs[0].Coverage, want)
+	}
+	if sfs[0].SourceDigest == "" {
+		t.Error("expected the digest of the source")
+	}
+}
+
+func TestMergeSourceFiles(t *testing.T) {
+	t.Parallel()
+
+	a := []*SourceFile{
+		{Name: "a.go", Coverage: []interface{}{nil, 1, 0}, Branches: []int{2, 0, 0, 1}},
+		{Name: "b.go", Coverage: []interface{}{1}},
+	}
+	b := []*SourceFile{
+		{Name: "a.go", Coverage: []interface{}{nil, 2, nil, 4}, Branches: []int{2, 0, 0, 1, 2, 0, 1, 3}},
+		{Name: "c.go", Coverage: []interface{}{nil, 0}},
+	}
+	got := mergeSourceFiles(a, b)
+	if len(got) != 3 || got[0].Name != "a.go" || got[1].Name != "b.go" || got[2].Name != "c.go" {
+		t.Fatalf("unexpected source files: %v", got)
+	}
+	if want := []interface{}{nil, 3, 0, 4}; !reflect.DeepEqual(got[0].Coverage, want) {
+		t.Errorf("coverage = %v, want %v", got[0].Coverage, want)
+	}
+	if want := []int{2, 0, 0, 2, 2, 0, 1, 3}; !reflect.DeepEqual(got[0].Branches, want) {
+		t.Errorf("branches = %v, want %v", got[0].Branches, want)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// A lineCoverage is the coverage of a relevant line of a source file.
+type lineCoverage struct {
+	number   int
+	hits     int
+	branches int // branches of the line
+	taken    int // branches of the line taken at least once
+}
+
+// fileLines returns the relevant lines of sf in order, with the branches of
+// sf.Branches.
+func fileLines(sf *SourceFile) []lineCoverage {
+	var lines []lineCoverage
+	index := make(map[int]int)
+	for i, c := range sf.Coverage {
+		if n, ok := c.(int); ok {
+			index[i+1] = len(lines)
+			lines = append(lines, lineCoverage{number: i + 1, hits: n})
+		}
+	}
+	for i := 0; i+3 < len(sf.Branches); i += 4 {
+		j, ok := index[sf.Branches[i]]
+		if !ok {
+			continue
+		}
+		lines[j].branches++
+		if sf.Branches[i+3] > 0 {
+			lines[j].taken++
+		}
+	}
+	return lines
+}
+
+// writeReports writes the coverage of the files in the formats requested
+// by -lcovout, -coberturaout and -sonarout.
+func writeReports(files []*SourceFile) error {
+	reports := []struct {
+		fn     string
+		format string
+		write  func(io.Writer, []*SourceFile) error
+	}{
+		{*lcovOut, "LCOV", writeLCOV},
+		{*coberturaOut, "Cobertura", writeCobertura},
+		{*sonarOut, "SonarQube", writeSonar},
+	}
+	for _, r := range reports {
+		if r.fn == "" {
+			continue
+		}
+		if err := writeReportFile(r.fn, files, r.write); err != nil {
+			return fmt.Errorf("cannot write %s report: %v", r.format, err)
+		}
+	}
+	return nil
+}
+
+func writeReportFile(fn string, files []*SourceFile, write func(io.Writer, []*SourceFile) error) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := write(f, files); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeLCOV writes the coverage of the files as an LCOV tracefile to w.
+func writeLCOV(w io.Writer, files []*SourceFile) error {
+	bw := bufio.NewWriter(w)
+	for _, sf := range files {
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", sf.Name)
+		var brf, brh int
+		for i := 0; i+3 < len(sf.Branches); i += 4 {
+			b := sf.Branches[i : i+4]
+			fmt.Fprintf(bw, "BRDA:%d,%d,%d,%d\n", b[0], b[1], b[2], b[3])
+			brf++
+			if b[3] > 0 {
+				brh++
+			}
+		}
+		if brf > 0 {
+			fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", brf, brh)
+		}
+		st := fileStats(sf)
+		for _, l := range fileLines(sf) {
+			fmt.Fprintf(bw, "DA:%d,%d\n", l.number, l.hits)
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", st.total, st.covered)
+	}
+	return bw.Flush()
+}
+
+// coberturaCoverage is a Cobertura XML report, as written by
+// writeCobertura.
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        float64            `xml:"line-rate,attr"`
+	BranchRate      float64            `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      int                `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   float64          `xml:"line-rate,attr"`
+	BranchRate float64          `xml:"branch-rate,attr"`
+	Complexity int              `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   float64         `xml:"line-rate,attr"`
+	BranchRate float64         `xml:"branch-rate,attr"`
+	Complexity int             `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number            int    `xml:"number,attr"`
+	Hits              int    `xml:"hits,attr"`
+	Branch            bool   `xml:"branch,attr"`
+	ConditionCoverage string `xml:"condition-coverage,attr,omitempty"`
+}
+
+// coberturaCounts counts the lines and branches of a Cobertura element.
+type coberturaCounts struct {
+	lines, linesCovered       int
+	branches, branchesCovered int
+}
+
+func (c *coberturaCounts) add(o coberturaCounts) {
+	c.lines += o.lines
+	c.linesCovered += o.linesCovered
+	c.branches += o.branches
+	c.branchesCovered += o.branchesCovered
+}
+
+func (c coberturaCounts) rates() (float64, float64) {
+	rate := func(n, d int) float64 {
+		if d == 0 {
+			return 1
+		}
+		return float64(n) / float64(d)
+	}
+	return rate(c.linesCovered, c.lines), rate(c.branchesCovered, c.branches)
+}
+
+// writeCobertura writes the coverage of the files as a Cobertura XML report
+// to w. The files are grouped in packages by directory, and their names are
+// relative to the root of the repository, given as the source.
+func writeCobertura(w io.Writer, files []*SourceFile) error {
+	sorted := append([]*SourceFile(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		di, dj := path.Dir(sorted[i].Name), path.Dir(sorted[j].Name)
+		if di != dj {
+			return di < dj
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	report := coberturaCoverage{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Sources:   []string{reportSourcePath(".")},
+	}
+	var total, pkgCounts coberturaCounts
+	closePackage := func() {
+		if len(report.Packages) > 0 {
+			p := &report.Packages[len(report.Packages)-1]
+			p.LineRate, p.BranchRate = pkgCounts.rates()
+			total.add(pkgCounts)
+		}
+		pkgCounts = coberturaCounts{}
+	}
+	for _, sf := range sorted {
+		dir := path.Dir(sf.Name)
+		if len(report.Packages) == 0 || report.Packages[len(report.Packages)-1].Name != dir {
+			closePackage()
+			report.Packages = append(report.Packages, coberturaPackage{Name: dir})
+		}
+
+		class := coberturaClass{Name: path.Base(sf.Name), Filename: sf.Name}
+		var counts coberturaCounts
+		for _, l := range fileLines(sf) {
+			line := coberturaLine{Number: l.number, Hits: l.hits}
+			counts.lines++
+			if l.hits > 0 {
+				counts.linesCovered++
+			}
+			if l.branches > 0 {
+				line.Branch = true
+				line.ConditionCoverage = fmt.Sprintf("%d%% (%d/%d)", l.taken*100/l.branches, l.taken, l.branches)
+				counts.branches += l.branches
+				counts.branchesCovered += l.taken
+			}
+			class.Lines = append(class.Lines, line)
+		}
+		class.LineRate, class.BranchRate = counts.rates()
+		pkgCounts.add(counts)
+
+		p := &report.Packages[len(report.Packages)-1]
+		p.Classes = append(p.Classes, class)
+	}
+	closePackage()
+	report.LineRate, report.BranchRate = total.rates()
+	report.LinesCovered, report.LinesValid = total.linesCovered, total.lines
+	report.BranchesCovered, report.BranchesValid = total.branchesCovered, total.branches
+
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`+"\n")
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// sonarCoverage is a report in the generic test coverage format of
+// SonarQube, as written by writeSonar.
+type sonarCoverage struct {
+	XMLName xml.Name    `xml:"coverage"`
+	Version int         `xml:"version,attr"`
+	Files   []sonarFile `xml:"file"`
+}
+
+type sonarFile struct {
+	Path  string      `xml:"path,attr"`
+	Lines []sonarLine `xml:"lineToCover"`
+}
+
+type sonarLine struct {
+	LineNumber      int  `xml:"lineNumber,attr"`
+	Covered         bool `xml:"covered,attr"`
+	BranchesToCover *int `xml:"branchesToCover,attr,omitempty"`
+	CoveredBranches *int `xml:"coveredBranches,attr,omitempty"`
+}
+
+// writeSonar writes the coverage of the files in the generic test coverage
+// format of SonarQube to w. The paths are relative to the root of the
+// repository.
+func writeSonar(w io.Writer, files []*SourceFile) error {
+	report := sonarCoverage{Version: 1}
+	for _, sf := range files {
+		f := sonarFile{Path: sf.Name}
+		for _, l := range fileLines(sf) {
+			line := sonarLine{LineNumber: l.number, Covered: l.hits > 0}
+			if l.branches > 0 {
+				branches, taken := l.branches, l.taken
+				line.BranchesToCover, line.CoveredBranches = &branches, &taken
+			}
+			f.Lines = append(f.Lines, line)
+		}
+		report.Files = append(report.Files, f)
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var exportFiles = []*SourceFile{
+	{Name: "pkg/a.go", Coverage: []interface{}{nil, 2, 0, nil, 1}, Branches: []int{2, 0, 0, 2, 2, 0, 1, 0}},
+	{Name: "pkg/sub/b.go", Coverage: []interface{}{1}},
+	{Name: "pkg/c.go", Coverage: []interface{}{nil, 0}},
+}
+
+func TestWriteLCOV(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := writeLCOV(&buf, exportFiles); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:pkg/a.go
+BRDA:2,0,0,2
+BRDA:2,0,1,0
+BRF:2
+BRH:1
+DA:2,2
+DA:3,0
+DA:5,1
+LF:3
+LH:2
+end_of_record
+TN:
+SF:pkg/sub/b.go
+DA:1,1
+LF:1
+LH:1
+end_of_record
+TN:
+SF:pkg/c.go
+DA:2,0
+LF:1
+LH:0
+end_of_record
+`
+	if buf.String() != want {
+		t.Errorf("writeLCOV() =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	// the tracefile is read back by -coverimport
+	files, err := parseLCOV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := files[0].coverage(); !reflect.DeepEqual(got, exportFiles[0].Coverage) {
+		t.Errorf("coverage = %v, want %v", got, exportFiles[0].Coverage)
+	}
+}
+
+func TestWriteCobertura(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := writeCobertura(&buf, exportFiles); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{
+		`<coverage line-rate="0.6" branch-rate="0.5" lines-covered="3" lines-valid="5" branches-covered="1" branches-valid="2"`,
+		`<package name="pkg" line-rate="0.5" branch-rate="0.5" complexity="0">`,
+		`<class name="a.go" filename="pkg/a.go" line-rate="0.6666666666666666" branch-rate="0.5" complexity="0">`,
+		`<line number="2" hits="2" branch="true" condition-coverage="50% (1/2)"></line>`,
+		`<line number="3" hits="0" branch="false"></line>`,
+		`<package name="pkg/sub" line-rate="1" branch-rate="1" complexity="0">`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %s in the report:\n%s", s, out)
+		}
+	}
+	// the files of a directory are in one package
+	if strings.Count(out, `<package name="pkg"`) != 1 {
+		t.Errorf("expected one package pkg:\n%s", out)
+	}
+
+	// the report is read back by -coverimport
+	files, _, err := parseCobertura(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[0].name != "pkg/a.go" || files[1].name != "pkg/c.go" || files[2].name != "pkg/sub/b.go" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	if want := map[int]int{2: 2, 3: 0, 5: 1}; !reflect.DeepEqual(files[0].lines, want) {
+		t.Errorf("lines = %v, want %v", files[0].lines, want)
+	}
+}
+
+func TestWriteSonar(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := writeSonar(&buf, exportFiles[:2]); err != nil {
+		t.Fatal(err)
+	}
+	want := `<coverage version="1">
+	<file path="pkg/a.go">
+		<lineToCover lineNumber="2" covered="true" branchesToCover="2" coveredBranches="1"></lineToCover>
+		<lineToCover lineNumber="3" covered="false"></lineToCover>
+		<lineToCover lineNumber="5" covered="true"></lineToCover>
+	</file>
+	<file path="pkg/sub/b.go">
+		<lineToCover lineNumber="1" covered="true"></lineToCover>
+	</file>
+</coverage>
+`
+	if buf.String() != want {
+		t.Errorf("writeSonar() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
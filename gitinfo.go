@@ -7,26 +7,19 @@ import (
 	"os"
 	"os/exec"
 	"strings"
-)
 
-// A Head object encapsulates information about the HEAD revision of a git repo.
-type Head struct {
-	ID             string `json:"id"`
-	AuthorName     string `json:"author_name,omitempty"`
-	AuthorEmail    string `json:"author_email,omitempty"`
-	CommitterName  string `json:"committer_name,omitempty"`
-	CommitterEmail string `json:"committer_email,omitempty"`
-	Message        string `json:"message"`
-}
+	"github.com/mattn/goveralls/coveralls"
+)
 
-// A Git object encapsulates information about a git repo.
-type Git struct {
-	Head   Head   `json:"head"`
-	Branch string `json:"branch"`
-}
+// Aliases of the git metadata sent to Coveralls.
+type (
+	Head = coveralls.Head
+	Git  = coveralls.Git
+)
 
 // collectGitInfo uses either environment variables or git commands to compose a Git metadata object.
-func collectGitInfo(ref string) (*Git, error) {
+// branch is the branch reported by the CI service, which is used unless GIT_BRANCH is set.
+func collectGitInfo(ref, branch string) (*Git, error) {
 	gitCmds := map[string][]string{
 		"GIT_ID":              {"rev-parse", ref},
 		"GIT_BRANCH":          {"branch", "--format", "%(refname:short)", "--contains", ref},
@@ -48,22 +41,22 @@ func collectGitInfo(ref string) (*Git, error) {
 
 		// make sure that the commit is in the local
 		// e.g. shallow cloned repository
-		_, err = runCommand(gitPath, "fetch", "--depth=1", "origin", ref)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch git ref %q: %v", ref, err)
+		if _, err := runCommand(gitPath, "cat-file", "-e", ref+"^{commit}"); err != nil {
+			_, err = runCommand(gitPath, "fetch", "--depth=1", "origin", ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch git ref %q: %v", ref, err)
+			}
 		}
 	}
 
 	for key, args := range gitCmds {
-		// special case for the git branch name: load from multiple environment variables
-		if key == "GIT_BRANCH" {
-			if envBranch := loadBranchFromEnv(); envBranch != "" {
-				err := os.Setenv(key, envBranch)
-				if err != nil {
-					return nil, err
-				}
-				continue
+		// special case for the git branch name: prefer the one of the CI service
+		if key == "GIT_BRANCH" && os.Getenv(key) == "" && branch != "" {
+			err := os.Setenv(key, branch)
+			if err != nil {
+				return nil, err
 			}
+			continue
 		}
 		if os.Getenv(key) != "" {
 			// metadata already available via environment variable
@@ -118,29 +111,3 @@ func runCommand(gitPath string, args ...string) (string, error) {
 	ret = bytes.TrimRight(ret, "\n")
 	return string(ret), nil
 }
-
-var varNames = [...]string{
-	"GIT_BRANCH",
-
-	// https://help.github.com/en/actions/automating-your-workflow-with-github-actions/using-environment-variables
-	"GITHUB_HEAD_REF", "GITHUB_REF",
-
-	"CIRCLE_BRANCH", "TRAVIS_BRANCH",
-	"CI_BRANCH", "APPVEYOR_REPO_BRANCH",
-	"WERCKER_GIT_BRANCH", "DRONE_BRANCH",
-	"BUILDKITE_BRANCH", "BRANCH_NAME",
-	"CI_COMMIT_REF_NAME",
-}
-
-func loadBranchFromEnv() string {
-	for _, varName := range varNames {
-		if branch := os.Getenv(varName); branch != "" {
-			if varName == "GITHUB_REF" {
-				return strings.TrimPrefix(branch, "refs/heads/")
-			}
-			return branch
-		}
-	}
-
-	return ""
-}
@@ -5,134 +5,55 @@ import (
 	"testing"
 )
 
-func TestLoadBranchFromEnv(t *testing.T) {
-	t.Parallel()
-
+func TestCollectGitInfoBranch(t *testing.T) {
 	var tests = []struct {
 		testCase       string
 		envs           map[string]string
+		ciBranch       string
 		expectedBranch string
 	}{
 		{
-			"all vars defined",
-			map[string]string{
-				"GIT_BRANCH":           "master",
-				"CIRCLE_BRANCH":        "circle-master",
-				"TRAVIS_BRANCH":        "travis-master",
-				"CI_BRANCH":            "ci-master",
-				"APPVEYOR_REPO_BRANCH": "appveyor-master",
-				"WERCKER_GIT_BRANCH":   "wercker-master",
-				"DRONE_BRANCH":         "drone-master",
-				"BUILDKITE_BRANCH":     "buildkite-master",
-				"BRANCH_NAME":          "jenkins-master",
-				"CI_COMMIT_REF_NAME":   "gitlab-master",
-			},
-			"master",
-		},
-		{
-			"all except GIT_BRANCH",
-			map[string]string{
-				"CIRCLE_BRANCH":        "circle-master",
-				"TRAVIS_BRANCH":        "travis-master",
-				"CI_BRANCH":            "ci-master",
-				"APPVEYOR_REPO_BRANCH": "appveyor-master",
-				"WERCKER_GIT_BRANCH":   "wercker-master",
-				"DRONE_BRANCH":         "drone-master",
-				"BUILDKITE_BRANCH":     "buildkite-master",
-				"BRANCH_NAME":          "jenkins-master",
-				"CI_COMMIT_REF_NAME":   "gitlab-master",
-			},
-			"circle-master",
-		},
-		{
-			"all except GIT_BRANCH and CIRCLE_BRANCH",
-			map[string]string{
-				"TRAVIS_BRANCH":        "travis-master",
-				"CI_BRANCH":            "ci-master",
-				"APPVEYOR_REPO_BRANCH": "appveyor-master",
-				"WERCKER_GIT_BRANCH":   "wercker-master",
-				"DRONE_BRANCH":         "drone-master",
-				"BUILDKITE_BRANCH":     "buildkite-master",
-				"BRANCH_NAME":          "jenkins-master",
-				"CI_COMMIT_REF_NAME":   "gitlab-master",
-			},
-			"travis-master",
-		},
-		{
-			"only CI_BRANCH defined",
-			map[string]string{
-				"CI_BRANCH": "ci-master",
-			},
+			"GIT_BRANCH defined",
+			map[string]string{"GIT_BRANCH": "master"},
 			"ci-master",
+			"master",
 		},
 		{
-			"only APPVEYOR_REPO_BRANCH defined",
-			map[string]string{
-				"APPVEYOR_REPO_BRANCH": "appveyor-master",
-			},
-			"appveyor-master",
-		},
-		{
-			"only WERCKER_GIT_BRANCH defined",
-			map[string]string{
-				"WERCKER_GIT_BRANCH": "wercker-master",
-			},
-			"wercker-master",
-		},
-		{
-			"only BRANCH_NAME defined",
-			map[string]string{
-				"BRANCH_NAME": "jenkins-master",
-			},
-			"jenkins-master",
-		},
-		{
-			"only BUILDKITE_BRANCH defined",
-			map[string]string{
-				"BUILDKITE_BRANCH": "buildkite-master",
-			},
-			"buildkite-master",
-		},
-		{
-			"only DRONE_BRANCH defined",
-			map[string]string{
-				"DRONE_BRANCH": "drone-master",
-			},
-			"drone-master",
-		},
-		{
-			"only CI_COMMIT_REF_NAME defined",
-			map[string]string{
-				"CI_COMMIT_REF_NAME": "gitlab-master",
-			},
-			"gitlab-master",
-		},
-		{
-			"GitHub Action push event",
-			map[string]string{
-				"GITHUB_REF": "refs/heads/github-master",
-			},
-			"github-master",
-		},
-		{
-			"no branch var defined",
+			"branch of the CI service",
 			map[string]string{},
-			"",
+			"ci-master",
+			"ci-master",
 		},
 	}
 	for _, test := range tests {
-		resetBranchEnvs(test.envs)
-		envBranch := loadBranchFromEnv()
-		if envBranch != test.expectedBranch {
-			t.Errorf("%s: wrong branch returned. Expected %q, but got %q", test.testCase, test.expectedBranch, envBranch)
+		resetGitEnvs(test.envs)
+		g, err := collectGitInfo("HEAD", test.ciBranch)
+		if err != nil {
+			t.Fatalf("%s: %v", test.testCase, err)
+		}
+		if g.Branch != test.expectedBranch {
+			t.Errorf("%s: wrong branch returned. Expected %q, but got %q", test.testCase, test.expectedBranch, g.Branch)
 		}
 	}
+	for _, envVar := range gitEnvNames {
+		os.Unsetenv(envVar)
+	}
 }
 
-func resetBranchEnvs(values map[string]string) {
-	for _, envVar := range varNames {
-		os.Unsetenv(envVar)
+var gitEnvNames = []string{
+	"GIT_ID", "GIT_BRANCH",
+	"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL",
+	"GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL",
+	"GIT_MESSAGE",
+}
+
+// resetGitEnvs sets all the git metadata variables so that collectGitInfo
+// doesn't run git, then overrides them with values.
+func resetGitEnvs(values map[string]string) {
+	for _, envVar := range gitEnvNames {
+		os.Setenv(envVar, "x")
 	}
+	os.Unsetenv("GIT_BRANCH")
 	for k, v := range values {
 		os.Setenv(k, v)
 	}
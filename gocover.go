@@ -9,25 +9,26 @@ package main
 // The rest is written by Dustin Sallings
 
 import (
+	"crypto/md5"
 	"fmt"
 	"go/build"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/tools/cover"
 )
 
-func findFile(rootPackage string, rootDir string, file string) (string, error) {
-	// If we find a file that is inside the root package, we already know
-	// where it should be!
-	if rootPackage != "" {
-		if relPath, _ := filepath.Rel(rootPackage, file); !strings.HasPrefix(relPath, "..") {
-			// The file is inside the root package...
-			return filepath.Join(rootDir, relPath), nil
-		}
+func findFile(mods []goModule, file string) (string, error) {
+	// If we find a file that is inside a module of the repository, we
+	// already know where it should be!
+	if mod, ok := moduleOf(mods, file, false); ok {
+		relPath, _ := filepath.Rel(mod.path, file)
+		return filepath.Join(mod.dir, relPath), nil
 	}
 
 	dir, file := filepath.Split(file)
@@ -39,15 +40,23 @@ func findFile(rootPackage string, rootDir string, file string) (string, error) {
 }
 
 // mergeProfs merges profiles for same target packages.
-// It assumes each profiles have same sorted FileName and Blocks.
-func mergeProfs(pfss [][]*cover.Profile) []*cover.Profile {
+// It assumes each profiles have sorted FileName and Blocks. Blocks that
+// differ between the profiles of a file are merged by mergeTwoProfBlock
+// with a warning. Profiles of different cover modes are merged as described
+// by normalizeModes, or rejected with -strict.
+func mergeProfs(pfss [][]*cover.Profile) ([]*cover.Profile, error) {
 	if len(pfss) == 0 {
-		return nil
+		return nil, nil
+	}
+	pfss, err := normalizeModes(pfss)
+	if err != nil {
+		return nil, err
 	}
+	differ := make(map[string]bool)
 	for len(pfss) > 1 {
 		i := 0
 		for ; 2*i+1 < len(pfss); i++ {
-			pfss[i] = mergeTwoProfs(pfss[2*i], pfss[2*i+1])
+			pfss[i] = mergeTwoProfs(pfss[2*i], pfss[2*i+1], differ)
 		}
 		if 2*i < len(pfss) {
 			pfss[i] = pfss[2*i]
@@ -55,17 +64,86 @@ func mergeProfs(pfss [][]*cover.Profile) []*cover.Profile {
 		}
 		pfss = pfss[:i]
 	}
-	return pfss[0]
+	if len(differ) > 0 {
+		files := make([]string, 0, len(differ))
+		for file := range differ {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		fmt.Fprintf(os.Stderr, "goveralls: warning: the blocks of these files differ between the profiles, which may come from different source revisions:\n  %s\n", strings.Join(files, "\n  "))
+	}
+	return pfss[0], nil
 }
 
-func mergeTwoProfs(left, right []*cover.Profile) []*cover.Profile {
+// normalizeModes returns the profiles converted to a common cover mode.
+// Profiles of count and atomic modes both count the runs of the blocks, so
+// they are merged as count profiles by adding the counts. If any profile
+// is of set mode, it only tells whether the blocks ran, so the counts of
+// the others are reduced to that and everything is merged in set mode,
+// with a warning. With -strict, profiles of set mode and counting profiles
+// are an error instead.
+func normalizeModes(pfss [][]*cover.Profile) ([][]*cover.Profile, error) {
+	modes := make(map[string]bool)
+	for _, profs := range pfss {
+		for _, prof := range profs {
+			if prof.Mode != "" {
+				modes[prof.Mode] = true
+			}
+		}
+	}
+	if len(modes) < 2 {
+		return pfss, nil
+	}
+
+	mode := "count"
+	if modes["set"] {
+		names := make([]string, 0, len(modes))
+		for m := range modes {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		if *strict {
+			return nil, fmt.Errorf("cannot merge profiles of cover modes %s", strings.Join(names, ", "))
+		}
+		fmt.Fprintf(os.Stderr, "goveralls: warning: merging profiles of cover modes %s in set mode; hit counts are lost\n", strings.Join(names, ", "))
+		mode = "set"
+	}
+
+	ret := make([][]*cover.Profile, len(pfss))
+	for i, profs := range pfss {
+		ret[i] = make([]*cover.Profile, len(profs))
+		for j, prof := range profs {
+			p := *prof
+			p.Mode = mode
+			if mode == "set" && prof.Mode != "set" {
+				p.Blocks = make([]cover.ProfileBlock, len(prof.Blocks))
+				for k, b := range prof.Blocks {
+					if b.Count > 0 {
+						b.Count = 1
+					}
+					p.Blocks[k] = b
+				}
+			}
+			ret[i][j] = &p
+		}
+	}
+	return ret, nil
+}
+
+// mergeTwoProfs merges two sorted lists of profiles. The names of the
+// files whose blocks differ between the lists are added to differ.
+func mergeTwoProfs(left, right []*cover.Profile, differ map[string]bool) []*cover.Profile {
 	ret := make([]*cover.Profile, 0, len(left)+len(right))
 	for len(left) > 0 && len(right) > 0 {
 		if left[0].FileName == right[0].FileName {
+			blocks, aligned := mergeTwoProfBlock(left[0].Blocks, right[0].Blocks, left[0].Mode == "set")
+			if !aligned {
+				differ[left[0].FileName] = true
+			}
 			profile := &cover.Profile{
 				FileName: left[0].FileName,
 				Mode:     left[0].Mode,
-				Blocks:   mergeTwoProfBlock(left[0].Blocks, right[0].Blocks),
+				Blocks:   blocks,
 			}
 			ret = append(ret, profile)
 			left = left[1:]
@@ -83,8 +161,15 @@ func mergeTwoProfs(left, right []*cover.Profile) []*cover.Profile {
 	return ret
 }
 
-func mergeTwoProfBlock(left, right []cover.ProfileBlock) []cover.ProfileBlock {
+// mergeTwoProfBlock merges the sorted blocks of two profiles of a file.
+// The counts of the same blocks are added, or, if set is true, a block runs
+// if it runs in any of the profiles. Blocks that overlap without being the
+// same, as in profiles of different revisions of the file, are split into
+// disjoint segments by splitBlocks. It reports whether the blocks of both
+// profiles are the same.
+func mergeTwoProfBlock(left, right []cover.ProfileBlock, set bool) ([]cover.ProfileBlock, bool) {
 	ret := make([]cover.ProfileBlock, 0, len(left)+len(right))
+	aligned := len(left) == len(right)
 	for len(left) > 0 && len(right) > 0 {
 		a, b := left[0], right[0]
 		if a.StartLine == b.StartLine && a.StartCol == b.StartCol && a.EndLine == b.EndLine && a.EndCol == b.EndCol {
@@ -94,51 +179,227 @@ func mergeTwoProfBlock(left, right []cover.ProfileBlock) []cover.ProfileBlock {
 				EndLine:   a.EndLine,
 				EndCol:    a.EndCol,
 				NumStmt:   a.NumStmt,
-				Count:     a.Count + b.Count,
+				Count:     addCounts(a.Count, b.Count, set),
 			})
 			left = left[1:]
 			right = right[1:]
-		} else if a.StartLine < b.StartLine || (a.StartLine == b.StartLine && a.StartCol < b.StartCol) {
-			ret = append(ret, a)
-			left = left[1:]
-		} else {
-			ret = append(ret, b)
-			right = right[1:]
+			continue
+		}
+		aligned = false
+		if !overlaps(a, b) {
+			if blockStart(a).before(blockStart(b)) {
+				ret = append(ret, a)
+				left = left[1:]
+			} else {
+				ret = append(ret, b)
+				right = right[1:]
+			}
+			continue
+		}
+
+		// Collect the blocks overlapping each other transitively.
+		ls, rs := []cover.ProfileBlock{a}, []cover.ProfileBlock{b}
+		left, right = left[1:], right[1:]
+		end := blockEnd(a)
+		if end.before(blockEnd(b)) {
+			end = blockEnd(b)
+		}
+		for {
+			if len(left) > 0 && blockStart(left[0]).before(end) {
+				ls = append(ls, left[0])
+				if end.before(blockEnd(left[0])) {
+					end = blockEnd(left[0])
+				}
+				left = left[1:]
+			} else if len(right) > 0 && blockStart(right[0]).before(end) {
+				rs = append(rs, right[0])
+				if end.before(blockEnd(right[0])) {
+					end = blockEnd(right[0])
+				}
+				right = right[1:]
+			} else {
+				break
+			}
 		}
+		ret = append(ret, splitBlocks(ls, rs, set)...)
 	}
 	ret = append(ret, left...)
 	ret = append(ret, right...)
-	return ret
+	return ret, aligned
+}
+
+// splitBlocks merges the overlapping blocks ls and rs of two profiles into
+// disjoint segments. The count of a segment is the sum of the counts of the
+// blocks covering it, or, if set is true, whether any of them ran. The
+// statements of a file can't be split, so the statements of every block of
+// the profile with the most statements are put into the first segment of
+// the block.
+func splitBlocks(ls, rs []cover.ProfileBlock, set bool) []cover.ProfileBlock {
+	var bounds []filePos
+	for _, blocks := range [][]cover.ProfileBlock{ls, rs} {
+		for _, b := range blocks {
+			bounds = append(bounds, blockStart(b), blockEnd(b))
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i].before(bounds[j])
+	})
+
+	// covering returns the count of the block of blocks covering the
+	// segment from start to end.
+	covering := func(blocks []cover.ProfileBlock, start, end filePos) (int, bool) {
+		for _, b := range blocks {
+			if !start.before(blockStart(b)) && !blockEnd(b).before(end) {
+				return b.Count, true
+			}
+		}
+		return 0, false
+	}
+	var segments []cover.ProfileBlock
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		lc, lok := covering(ls, start, end)
+		rc, rok := covering(rs, start, end)
+		if !lok && !rok {
+			continue
+		}
+		segments = append(segments, cover.ProfileBlock{
+			StartLine: start.line,
+			StartCol:  start.col,
+			EndLine:   end.line,
+			EndCol:    end.col,
+			Count:     addCounts(lc, rc, set),
+		})
+	}
+
+	stmts := ls
+	if numStmt(rs) > numStmt(ls) {
+		stmts = rs
+	}
+	for _, b := range stmts {
+		for i := range segments {
+			if blockStart(segments[i]) == blockStart(b) {
+				segments[i].NumStmt += b.NumStmt
+				break
+			}
+		}
+	}
+	return segments
+}
+
+// continuesBlock reports whether the block b continues a, both being
+// segments of blocks split by splitBlocks. Since the statements of a split
+// block are put into its first segment, one of them has none.
+func continuesBlock(a, b cover.ProfileBlock) bool {
+	return blockEnd(a) == blockStart(b) && (a.NumStmt == 0 || b.NumStmt == 0)
+}
+
+// addCounts returns the count of a block merged from blocks of the counts
+// a and b.
+func addCounts(a, b int, set bool) int {
+	if set && a+b > 0 {
+		return 1
+	}
+	return a + b
+}
+
+func numStmt(blocks []cover.ProfileBlock) int {
+	n := 0
+	for _, b := range blocks {
+		n += b.NumStmt
+	}
+	return n
+}
+
+// A filePos is a position in a source file.
+type filePos struct {
+	line, col int
+}
+
+func (p filePos) before(q filePos) bool {
+	return p.line < q.line || (p.line == q.line && p.col < q.col)
+}
+
+func blockStart(b cover.ProfileBlock) filePos {
+	return filePos{b.StartLine, b.StartCol}
+}
+
+func blockEnd(b cover.ProfileBlock) filePos {
+	return filePos{b.EndLine, b.EndCol}
+}
+
+// overlaps reports whether the blocks a and b share a part of the source.
+func overlaps(a, b cover.ProfileBlock) bool {
+	return blockStart(a).before(blockEnd(b)) && blockStart(b).before(blockEnd(a))
 }
 
 // toSF converts profiles to sourcefiles for coveralls.
 func toSF(profs []*cover.Profile) ([]*SourceFile, error) {
-	// find root package to reduce build.Import calls when importing files from relative root
+	// find the modules to reduce build.Import calls when importing files from their roots
 	// https://github.com/mattn/goveralls/pull/195
 	rootDirectory, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("get working dir: %v", err)
 	}
-	rootPackage := findRootPackage(rootDirectory)
+	mods, err := findModules(rootDirectory, *multiModule)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find modules: %v", err)
+	}
 
 	var rv []*SourceFile
 	for _, prof := range profs {
-		path, err := findFile(rootPackage, rootDirectory, prof.FileName)
+		path, err := findFile(mods, prof.FileName)
 		if err != nil {
 			return nil, fmt.Errorf("cannot find file %q: %v", prof.FileName, err)
 		}
-		sf := &SourceFile{
-			Name: getCoverallsSourceFileName(path),
+		sf, fb, err := readSourceFile(path)
+		if err != nil {
+			return nil, err
 		}
 		lineLookup := map[int]int{}
 		maxLineNo := 0
-		for _, block := range prof.Blocks {
-			for i := block.StartLine; i <= block.EndLine; i++ {
-				lineLookup[i] += block.Count
+		switch *lineMode {
+		case "blocks":
+			// chain is the count added to the last line of the previous
+			// block by it and the segments it continues.
+			chain := 0
+			for j, block := range prof.Blocks {
+				first := block.StartLine
+				if j > 0 && continuesBlock(prof.Blocks[j-1], block) {
+					// the line where the segments meet is counted once
+					if block.Count > chain {
+						lineLookup[first] += block.Count - chain
+						chain = block.Count
+					}
+					first++
+				} else {
+					chain = block.Count
+				}
+				for i := first; i <= block.EndLine; i++ {
+					lineLookup[i] += block.Count
+				}
+				if block.EndLine > block.StartLine {
+					chain = block.Count
+				}
+				if block.EndLine > maxLineNo {
+					maxLineNo = block.EndLine
+				}
+			}
+		case "statements":
+			lineLookup, err = statementLines(path, fb, prof.Blocks)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse source of file %q: %v", path, err)
 			}
-			if block.EndLine > maxLineNo {
-				maxLineNo = block.EndLine
+			for i := range lineLookup {
+				if i > maxLineNo {
+					maxLineNo = i
+				}
 			}
+		default:
+			return nil, fmt.Errorf("unknown -linemode %q", *lineMode)
 		}
 		sf.Coverage = make([]interface{}, maxLineNo)
 		for i := 1; i <= maxLineNo; i++ {
@@ -146,12 +407,11 @@ func toSF(profs []*cover.Profile) ([]*SourceFile, error) {
 				sf.Coverage[i-1] = c
 			}
 		}
-		if *uploadSource {
-			fb, err := ioutil.ReadFile(path)
+		if *branches {
+			sf.Branches, err = branchCoverage(path, fb, prof.Blocks, prof.Mode)
 			if err != nil {
-				return nil, fmt.Errorf("cannot read source of file %q: %v", path, err)
+				return nil, fmt.Errorf("cannot parse source of file %q: %v", path, err)
 			}
-			sf.Source = string(fb)
 		}
 
 		rv = append(rv, sf)
@@ -160,22 +420,71 @@ func toSF(profs []*cover.Profile) ([]*SourceFile, error) {
 	return rv, nil
 }
 
-func parseCover(fn string) ([]*SourceFile, error) {
+// readSourceFile returns the source file for coveralls of the local file
+// path, without its coverage, and the content of the file.
+func readSourceFile(path string) (*SourceFile, []byte, error) {
+	fb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read source of file %q: %v", path, err)
+	}
+	sf := &SourceFile{
+		Name: getCoverallsSourceFileName(path),
+		// Coveralls verifies the file by the digest even if the source isn't uploaded.
+		SourceDigest: fmt.Sprintf("%x", md5.Sum(fb)),
+	}
+	if *uploadSource {
+		sf.Source = string(fb)
+	}
+	return sf, fb, nil
+}
+
+// parseCover parses the profiles given by the comma separated list of
+// -coverprofile, as found by findProfiles, and merges them.
+func parseCover(fn string) ([]*cover.Profile, error) {
+	files, err := findProfiles(fn, isProfile)
+	if err != nil {
+		return nil, fmt.Errorf("error finding coverage: %v", err)
+	}
 	var pfss [][]*cover.Profile
-	for _, p := range strings.Split(fn, ",") {
-		profs, err := cover.ParseProfiles(p)
+	for _, p := range files {
+		if p == "-" {
+			fmt.Println("goveralls: reading profile from stdin")
+		} else {
+			fmt.Println("goveralls: reading profile", p)
+		}
+		profs, err := readProfile(p)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing coverage: %v", err)
 		}
 		pfss = append(pfss, profs)
 	}
+	return mergeProfs(pfss)
+}
 
-	sourceFiles, err := toSF(mergeProfs(pfss))
-	if err != nil {
-		return nil, err
+// parseCoverDirs converts the binary coverage data in the comma separated
+// directories, which programs built with 'go build -cover' write to
+// GOCOVERDIR, to profiles.
+func parseCoverDirs(dirs string) ([][]*cover.Profile, error) {
+	var pfss [][]*cover.Profile
+	for _, dir := range strings.Split(dirs, ",") {
+		f, err := ioutil.TempFile("", "goveralls")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		out, err := exec.Command("go", "tool", "covdata", "textfmt", "-i", dir, "-o", f.Name()).CombinedOutput()
+		if err != nil {
+			os.Remove(f.Name())
+			return nil, fmt.Errorf("cannot convert coverage data in %q: %v: %s", dir, err, out)
+		}
+		profs, err := cover.ParseProfiles(f.Name())
+		os.Remove(f.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing coverage data in %q: %v", dir, err)
+		}
+		pfss = append(pfss, profs)
 	}
-
-	return sourceFiles, nil
+	return pfss, nil
 }
 
 func findRootPackage(rootDirectory string) string {
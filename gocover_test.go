@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"golang.org/x/tools/cover"
@@ -70,8 +76,219 @@ func TestMergeProfs(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		if got := mergeProfs(tt.in); !reflect.DeepEqual(got, tt.want) {
+		got, err := mergeProfs(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
 			t.Errorf("mergeProfs(%#v) = %#v, want %#v", tt.in, got, tt.want)
 		}
 	}
 }
+
+func TestMergeProfsModes(t *testing.T) {
+	t.Parallel()
+
+	prof := func(mode string, counts ...int) []*cover.Profile {
+		p := &cover.Profile{FileName: "name1", Mode: mode}
+		for i, c := range counts {
+			p.Blocks = append(p.Blocks, cover.ProfileBlock{StartLine: i + 1, Count: c})
+		}
+		return []*cover.Profile{p}
+	}
+	tests := []struct {
+		in   [][]*cover.Profile
+		want []*cover.Profile
+	}{
+		// set profiles are merged as set
+		{
+			in:   [][]*cover.Profile{prof("set", 1, 0, 0), prof("set", 1, 1, 0)},
+			want: prof("set", 1, 1, 0),
+		},
+		// counting profiles keep the counts
+		{
+			in:   [][]*cover.Profile{prof("count", 3, 0, 0), prof("atomic", 2, 1, 0)},
+			want: prof("count", 5, 1, 0),
+		},
+		// counts are reduced to set
+		{
+			in:   [][]*cover.Profile{prof("count", 3, 0, 0), prof("set", 0, 1, 0), prof("atomic", 2, 0, 0)},
+			want: prof("set", 1, 1, 0),
+		},
+	}
+	for _, tt := range tests {
+		in := fmt.Sprintf("%v", tt.in)
+		got, err := mergeProfs(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeProfs(%s) = %v, want %v", in, got, tt.want)
+		}
+	}
+}
+
+func TestMergeTwoProfBlock(t *testing.T) {
+	t.Parallel()
+
+	block := func(startLine, endLine, numStmt, count int) cover.ProfileBlock {
+		return cover.ProfileBlock{StartLine: startLine, StartCol: 1, EndLine: endLine, EndCol: 1, NumStmt: numStmt, Count: count}
+	}
+	tests := []struct {
+		left, right []cover.ProfileBlock
+		set         bool
+		want        []cover.ProfileBlock
+		aligned     bool
+	}{
+		// the same blocks
+		{
+			left:    []cover.ProfileBlock{block(1, 3, 2, 1), block(3, 5, 1, 0)},
+			right:   []cover.ProfileBlock{block(1, 3, 2, 2), block(3, 5, 1, 0)},
+			want:    []cover.ProfileBlock{block(1, 3, 2, 3), block(3, 5, 1, 0)},
+			aligned: true,
+		},
+		{
+			left:    []cover.ProfileBlock{block(1, 3, 2, 1)},
+			right:   []cover.ProfileBlock{block(1, 3, 2, 1)},
+			set:     true,
+			want:    []cover.ProfileBlock{block(1, 3, 2, 1)},
+			aligned: true,
+		},
+		// disjoint blocks
+		{
+			left:  []cover.ProfileBlock{block(1, 3, 2, 1), block(7, 9, 1, 1)},
+			right: []cover.ProfileBlock{block(4, 6, 1, 0)},
+			want:  []cover.ProfileBlock{block(1, 3, 2, 1), block(4, 6, 1, 0), block(7, 9, 1, 1)},
+		},
+		// overlapping blocks are split
+		{
+			left:  []cover.ProfileBlock{block(1, 5, 2, 1), block(6, 8, 1, 0), block(10, 12, 1, 4)},
+			right: []cover.ProfileBlock{block(3, 7, 3, 2), block(10, 12, 1, 1)},
+			want: []cover.ProfileBlock{
+				block(1, 3, 2, 1),
+				block(3, 5, 0, 3),
+				block(5, 6, 0, 2),
+				block(6, 7, 1, 2),
+				block(7, 8, 0, 0),
+				block(10, 12, 1, 5),
+			},
+		},
+		// the statements are taken from the profile with the most
+		{
+			left:  []cover.ProfileBlock{block(1, 5, 1, 0)},
+			right: []cover.ProfileBlock{block(2, 4, 2, 1)},
+			set:   true,
+			want: []cover.ProfileBlock{
+				block(1, 2, 0, 0),
+				block(2, 4, 2, 1),
+				block(4, 5, 0, 0),
+			},
+		},
+	}
+	for i, tt := range tests {
+		got, aligned := mergeTwoProfBlock(tt.left, tt.right, tt.set)
+		if !reflect.DeepEqual(got, tt.want) || aligned != tt.aligned {
+			t.Errorf("#%d: mergeTwoProfBlock() = %v, %v, want %v, %v", i, got, aligned, tt.want, tt.aligned)
+		}
+	}
+}
+
+func TestParseCoverDirs(t *testing.T) {
+	t.Parallel()
+
+	major, minor, err := goVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if major == 1 && minor < 20 {
+		t.Skip("go build -cover requires Go 1.20")
+	}
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":  "module example.com/covdir\n\ngo 1.20\n",
+		"main.go": "package main\n\nimport \"os\"\n\nfunc main() {\n\tif len(os.Args) > 1 {\n\t\tprintln(\"arg\")\n\t}\n}\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "build", "-cover", "-o", "covdir")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build -cover: %v\n%s", err, out)
+	}
+
+	var covDirs []string
+	for _, args := range [][]string{nil, {"arg"}} {
+		covDir := filepath.Join(dir, fmt.Sprint("cov", len(covDirs)))
+		if err := os.Mkdir(covDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(filepath.Join(dir, "covdir"), args...)
+		cmd.Env = append(os.Environ(), "GOCOVERDIR="+covDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("running covdir: %v\n%s", err, out)
+		}
+		covDirs = append(covDirs, covDir)
+	}
+
+	pfss, err := parseCoverDirs(strings.Join(covDirs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pfss) != 2 {
+		t.Fatalf("expected the profiles of 2 directories, but got %d", len(pfss))
+	}
+	profs, err := mergeProfs(pfss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profs) != 1 || profs[0].FileName != "example.com/covdir/main.go" {
+		t.Fatalf("unexpected profiles: %v", profs)
+	}
+	for _, b := range profs[0].Blocks {
+		if b.Count == 0 {
+			t.Errorf("expected block %v to be covered by the merged runs", b)
+		}
+	}
+
+	if _, err := parseCoverDirs(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestToSFSplitBlocks(t *testing.T) {
+	t.Parallel()
+
+	const file = "github.com/mattn/goveralls/tester/tester.go"
+	left := []*cover.Profile{{FileName: file, Mode: "count", Blocks: []cover.ProfileBlock{
+		{StartLine: 7, StartCol: 1, EndLine: 11, EndCol: 1, NumStmt: 2, Count: 1},
+	}}}
+	right := []*cover.Profile{{FileName: file, Mode: "count", Blocks: []cover.ProfileBlock{
+		{StartLine: 7, StartCol: 1, EndLine: 11, EndCol: 5, NumStmt: 3, Count: 2},
+		{StartLine: 12, StartCol: 2, EndLine: 12, EndCol: 10, NumStmt: 1, Count: 4},
+	}}}
+	profs, err := mergeProfs([][]*cover.Profile{left, right})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfs, err := toSF(profs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sfs) != 1 {
+		t.Fatalf("unexpected source files: %v", sfs)
+	}
+	// line 11, where the segments of the split blocks meet, is counted once
+	want := []interface{}{nil, nil, nil, nil, nil, nil, 3, 3, 3, 3, 3, 4}
+	if !reflect.DeepEqual(sfs[0].Coverage, want) {
+		t.Errorf("coverage = %v, want %v", sfs[0].Coverage, want)
+	}
+}
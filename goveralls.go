@@ -7,6 +7,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "crypto/sha512"
 	"crypto/tls"
 	"encoding/json"
@@ -14,18 +15,21 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/mattn/goveralls/coveralls"
 	"golang.org/x/tools/cover"
 	"golang.org/x/tools/go/buildutil"
 )
@@ -50,11 +54,15 @@ func (a *Flags) Set(value string) error {
 
 var (
 	extraFlags    Flags
+	tagSetFlags   Flags
 	pkg           = flag.String("package", "", "Go package")
 	verbose       = flag.Bool("v", false, "Pass '-v' argument to 'go test' and output to stdout")
 	race          = flag.Bool("race", false, "Pass '-race' argument to 'go test'")
+	jobs          = flag.Int("jobs", runtime.GOMAXPROCS(0), "Number of packages to test at once")
+	testMode      = flag.String("testmode", "auto", "How to run the tests: \"single\" runs one 'go test' for all packages, \"package\" runs one per package, \"auto\" chooses \"single\" if the Go version supports it")
 	debug         = flag.Bool("debug", false, "Enable debug output")
-	coverprof     = flag.String("coverprofile", "", "If supplied, use a go cover profile (comma separated)")
+	coverprof     = flag.String("coverprofile", "", "If supplied, use go cover profiles (comma separated files, directories, globs, or - for stdin)")
+	coverdir      = flag.String("coverdir", "", "If supplied, merge the coverage data directories written by programs built with 'go build -cover' (comma separated)")
 	covermode     = flag.String("covermode", "count", "sent as covermode argument to go test")
 	repotoken     = flag.String("repotoken", os.Getenv("COVERALLS_TOKEN"), "Repository Token on coveralls")
 	reponame      = flag.String("reponame", "", "Repository name")
@@ -63,20 +71,47 @@ var (
 	endpoint      = flag.String("endpoint", "https://coveralls.io", "Hostname to submit Coveralls data to")
 	service       = flag.String("service", "", "The CI service or other environment in which the test suite was run. ")
 	shallow       = flag.Bool("shallow", false, "Shallow coveralls internal server errors")
+	retries       = flag.Int("retries", 0, "Number of times to retry the upload after a network error, 5xx or 429 response, or maintenance of coveralls")
+	retryWait     = flag.Duration("retrywait", coveralls.DefaultRetryWait, "Wait before the first retry, doubled on every retry")
 	ignore        = flag.String("ignore", "", "Comma separated files to ignore")
 	insecure      = flag.Bool("insecure", false, "Set insecure to skip verification of certificates")
-	uploadSource  = flag.Bool("uploadsource", true, "Read local source and upload it to coveralls")
+	uploadSource  = flag.Bool("uploadsource", true, "Read local source and upload it to coveralls; only its MD5 digest is sent otherwise")
+	lineMode      = flag.String("linemode", "blocks", "Lines reported as covered: \"blocks\" are all the lines of the covered blocks, \"statements\" are the lines holding statements, with the count of their innermost block")
+	branches      = flag.Bool("branches", false, "Report branch coverage of if, switch and select statements")
 	allowGitFetch = flag.Bool("allowgitfetch", true, "Perform a 'git fetch' when the reference is different than HEAD; used for GitHub Actions integration")
 	show          = flag.Bool("show", false, "Show which package is being tested")
 	customJobID   = flag.String("jobid", "", "Custom set job token")
 	jobNumber     = flag.String("jobnumber", "", "Custom set job number")
 	flagName      = flag.String("flagname", os.Getenv("COVERALLS_FLAG_NAME"), "Job flag name, e.g. \"Unit\", \"Functional\", or \"Integration\". Will be shown in the Coveralls UI.")
 
-	parallelFinish = flag.Bool("parallel-finish", false, "finish parallel test")
+	parallelFinish    = flag.Bool("parallel-finish", false, "finish parallel test")
+	summary           = flag.Bool("summary", false, "Show the line coverage of each package and file")
+	testSummary       = flag.Bool("testsummary", false, "Run the tests with -json and show their results and the coverage of each package")
+	testJSON          = flag.String("testjson", "", "Show the results of the tests in a file of 'go test -json' output, like -testsummary")
+	summaryLimit      = flag.Int("summarylimit", 0, "Show only the given number of packages and files with the worst coverage in the summary")
+	htmlReport        = flag.String("html", "", "Write an HTML report of the coverage to the given directory")
+	minCoverage       = flag.Float64("min-coverage", 0, "Fail if the total statement coverage, not the line coverage of -summary, is below the given percentage; lines are counted with -coverimport")
+	minCoverageFile   = flag.String("min-coverage-file", "", "File of minimum statement coverage percentages per package, one \"pattern percentage\" per line")
+	upload            = flag.Bool("upload", true, "Post the job to coveralls; set false to only report the coverage locally")
+	lcovOut           = flag.String("lcovout", "", "Write the coverage as an LCOV tracefile to the given file")
+	coberturaOut      = flag.String("coberturaout", "", "Write the coverage as a Cobertura XML report to the given file")
+	sonarOut          = flag.String("sonarout", "", "Write the coverage in the generic test coverage format of SonarQube to the given file")
+	saveJob           = flag.String("savejob", "", "Write the job to a JSON file instead of posting it to coveralls")
+	continueOnFailure = flag.Bool("continue-on-failure", false, "Upload the coverage of the tests even if the tests of some packages fail, and exit with an error afterwards")
+	coverScope        = flag.String("coverscope", "packages", "Packages covered by each test binary: \"packages\" are all the tested packages, \"package\" is the tested package only, \"module\" are all the packages of the module")
+	coverPkg          = flag.String("coverpkg", "", "Comma separated patterns of the packages covered by each test binary, instead of -coverscope")
+	testMapFile       = flag.String("testmap", "", "Run every test on its own and write the index of the tests covering each line to the given JSON file")
+	coveredByLine     = flag.String("coveredby", "", "Show the tests covering file:line according to the index of -testmap")
+	multiModule       = flag.Bool("multimodule", false, "Test every module of the go.work file, or of the go.mod files in the current directory and its subdirectories")
+	flagPerModule     = flag.Bool("flagpermodule", false, "Submit a parallel job per module, flagged with the module path")
+	coverImport       = flag.String("coverimport", "", "If supplied, merge coverage reports in LCOV, Cobertura XML or gocov JSON format (comma separated files, directories, globs, or - for stdin); the tests aren't run unless -coverprofile is given too")
+	strict            = flag.Bool("strict", false, "Fail instead of merging profiles of set cover mode with profiles of count or atomic mode")
+	uploadJob         = flag.String("uploadjob", "", "Post the job in a JSON file written by -savejob to coveralls")
 )
 
 func init() {
 	flag.Var((*buildutil.TagsFlag)(&build.Default.BuildTags), "tags", buildutil.TagsFlagDoc)
+	flag.Var(&tagSetFlags, "tagset", "Build tags of a run of the tests, separated by commas or spaces; the tests are run for each -tagset and merged")
 }
 
 // usage supplants package flag's Usage variable
@@ -87,50 +122,30 @@ var usage = func() {
 	flag.PrintDefaults()
 }
 
-// A SourceFile represents a source code file and its coverage data for a
-// single job.
-type SourceFile struct {
-	Name     string        `json:"name"`     // File path of this source file
-	Source   string        `json:"source"`   // Full source code of this file
-	Coverage []interface{} `json:"coverage"` // Requires both nulls and integers
-}
-
-// A Job represents the coverage data from a single run of a test suite.
-type Job struct {
-	RepoToken          *string       `json:"repo_token,omitempty"`
-	ServiceJobID       string        `json:"service_job_id"`
-	ServiceJobNumber   string        `json:"service_job_number,omitempty"`
-	ServicePullRequest string        `json:"service_pull_request,omitempty"`
-	ServiceName        string        `json:"service_name"`
-	FlagName           string        `json:"flag_name,omitempty"`
-	SourceFiles        []*SourceFile `json:"source_files"`
-	Parallel           *bool         `json:"parallel,omitempty"`
-	Git                *Git          `json:"git,omitempty"`
-	RunAt              time.Time     `json:"run_at"`
-}
-
-// A Response is returned by the Coveralls.io API.
-type Response struct {
-	Message string `json:"message"`
-	URL     string `json:"url"`
-	Error   bool   `json:"error"`
-}
-
-// A WebHookResponse is returned by the Coveralls.io WebHook.
-type WebHookResponse struct {
-	Done bool `json:"done"`
-}
+// Aliases of the types exchanged with the Coveralls.io API.
+type (
+	SourceFile      = coveralls.SourceFile
+	Job             = coveralls.Job
+	Response        = coveralls.Response
+	WebHookResponse = coveralls.WebHookResponse
+)
 
-// getPkgs returns packages for measuring coverage. Returned packages doesn't
-// contain vendor packages.
-func getPkgs(pkg string) ([]string, error) {
+// getPkgs returns packages for measuring coverage in the module directory
+// dir, or the current directory if dir is empty, with the comma separated
+// build tags. Returned packages doesn't contain vendor packages.
+func getPkgs(dir, pkg, tags string) ([]string, error) {
 	argList := []string{"list"}
+	if tags != "" {
+		argList = append(argList, "-tags", tags)
+	}
 	if pkg == "" {
 		argList = append(argList, "./...")
 	} else {
 		argList = append(argList, strings.Split(pkg, " ")...)
 	}
-	out, err := exec.Command("go", argList...).CombinedOutput()
+	cmd := exec.Command("go", argList...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, err
 	}
@@ -149,69 +164,462 @@ func getPkgs(pkg string) ([]string, error) {
 	return pkgs, nil
 }
 
-func getCoverage() ([]*SourceFile, error) {
-	if *coverprof != "" {
-		return parseCover(*coverprof)
+// getCoverage returns the merged profiles of the tests, or of the profiles
+// given by -coverprofile, and of the coverage data directories given by
+// -coverdir. With -continue-on-failure, the packages whose tests failed
+// are returned too. If results isn't nil, the tests are run with -json and
+// their results are added to it.
+func getCoverage(results *testResults) ([]*cover.Profile, []string, error) {
+	var profs []*cover.Profile
+	var failed []string
+	var err error
+	switch {
+	case *coverprof != "":
+		profs, err = parseCover(*coverprof)
+	case *coverImport != "":
+		// only the imported reports are merged with -coverdir
+	default:
+		profs, failed, err = getTagSetsCoverage(results)
 	}
-
-	// pkgs is packages to run tests and get coverage.
-	pkgs, err := getPkgs(*pkg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if *coverdir == "" {
+		return profs, failed, nil
+	}
+	pfss, err := parseCoverDirs(*coverdir)
+	if err != nil {
+		return nil, nil, err
 	}
-	coverpkg := fmt.Sprintf("-coverpkg=%s", strings.Join(pkgs, ","))
+	profs, err = mergeProfs(append([][]*cover.Profile{profs}, pfss...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return profs, failed, nil
+}
+
+// tagSets returns the comma separated build tags of each run of the tests:
+// the ones given by -tagset, or else the ones given by -tags.
+func tagSets() []string {
+	if len(tagSetFlags) == 0 {
+		return []string{strings.Join(build.Default.BuildTags, ",")}
+	}
+	sets := make([]string, len(tagSetFlags))
+	for i, set := range tagSetFlags {
+		sets[i] = strings.Join(strings.FieldsFunc(set, func(r rune) bool {
+			return r == ',' || r == ' '
+		}), ",")
+	}
+	return sets
+}
+
+// getTagSetsCoverage runs the tests with each set of build tags and returns
+// the merged profiles and the packages whose tests failed. With several
+// sets and -summary, the coverage of every set is shown.
+func getTagSetsCoverage(results *testResults) ([]*cover.Profile, []string, error) {
+	sets := tagSets()
+	if len(sets) == 1 {
+		return getTestCoverage(sets[0], results)
+	}
+
 	var pfss [][]*cover.Profile
-	for _, line := range pkgs {
-		f, err := ioutil.TempFile("", "goveralls")
+	var failed []string
+	for _, tags := range sets {
+		profs, f, err := getTestCoverage(tags, results)
 		if err != nil {
-			return nil, err
-		}
-		f.Close()
-		cmd := exec.Command("go")
-		outBuf := new(bytes.Buffer)
-		cmd.Stdout = outBuf
-		cmd.Stderr = outBuf
-		coverm := *covermode
-		if *race {
-			coverm = "atomic"
-		}
-		args := []string{"go", "test", "-covermode", coverm, "-coverprofile", f.Name(), coverpkg}
-		if *verbose {
-			args = append(args, "-v")
-			cmd.Stdout = os.Stdout
+			return nil, nil, fmt.Errorf("tags %q: %v", tags, err)
 		}
-		if *race {
-			args = append(args, "-race")
+		if *summary {
+			_, total := statementStats(profs)
+			fmt.Printf("goveralls: tags %q: %d of %d statements covered (%.1f%%)\n", tags, total.covered, total.total, total.percent())
+		}
+		for _, pkg := range f {
+			failed = append(failed, fmt.Sprintf("%s (tags %q)", pkg, tags))
+		}
+		pfss = append(pfss, profs)
+	}
+	profs, err := mergeProfs(pfss)
+	if err != nil {
+		return nil, nil, err
+	}
+	return profs, failed, nil
+}
+
+// getTestCoverage runs the tests with the comma separated build tags and
+// returns the merged profiles and the packages whose tests failed. With
+// -multimodule, the tests of every module are run.
+func getTestCoverage(tags string, results *testResults) ([]*cover.Profile, []string, error) {
+	if !*multiModule {
+		return getModuleCoverage("", tags, results)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, err
+	}
+	mods, err := findModules(wd, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot find modules: %v", err)
+	}
+	var pfss [][]*cover.Profile
+	var failed []string
+	for _, mod := range mods {
+		profs, f, err := getModuleCoverage(mod.dir, tags, results)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", mod.path, err)
 		}
-		args = append(args, extraFlags...)
-		args = append(args, line)
-		cmd.Args = args
+		pfss = append(pfss, profs)
+		failed = append(failed, f...)
+	}
+	profs, err := mergeProfs(pfss)
+	if err != nil {
+		return nil, nil, err
+	}
+	return profs, failed, nil
+}
+
+// getModuleCoverage runs the tests of the module in dir, or in the current
+// directory if dir is empty, with the build tags and returns the merged
+// profiles and the packages whose tests failed.
+func getModuleCoverage(dir, tags string, results *testResults) ([]*cover.Profile, []string, error) {
+	// pkgs is packages to run tests and get coverage.
+	pkgs, err := getPkgs(dir, *pkg, tags)
+	if err != nil {
+		return nil, nil, err
+	}
+	coverpkg, err := coverPkgFlag(dir, pkgs)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	single, err := useSingleTest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if single {
+		return runSingleTest(dir, tags, pkgs, coverpkg, results)
+	}
+
+	// Fall back to a 'go test' per package and merge their profiles.
+	var pfss [][]*cover.Profile
+	var failed []string
+	err = runPkgTests(pkgs, func(ctx context.Context, pkg string) pkgTestResult {
+		return runPkgTest(ctx, dir, tags, pkg, coverpkg, results != nil)
+	}, func(pkg string, r pkgTestResult) error {
 		if *show {
-			fmt.Println("goveralls:", line)
+			fmt.Println("goveralls:", pkg)
 		}
-		err = cmd.Run()
-		if err != nil {
-			return nil, fmt.Errorf("%v: %v", err, outBuf.String())
+		if *verbose {
+			os.Stdout.Write(r.stdout)
 		}
+		if r.tests != nil {
+			results.merge(r.tests)
+		}
+		if r.err != nil {
+			if !*continueOnFailure {
+				return r.err
+			}
+			fmt.Fprintf(os.Stderr, "goveralls: tests of %s failed: %v\n", pkg, r.err)
+			failed = append(failed, pkg)
+		}
+		pfss = append(pfss, r.profs)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	profs, err := mergeProfs(pfss)
+	if err != nil {
+		return nil, nil, err
+	}
+	return profs, failed, nil
+}
 
-		pfs, err := cover.ParseProfiles(f.Name())
+// coverPkgFlag returns the -coverpkg flag of 'go test' selected by -coverpkg
+// and -coverscope for the tests of pkgs in the module in dir, or an empty
+// string if the test binaries cover their own package only.
+func coverPkgFlag(dir string, pkgs []string) (string, error) {
+	if *coverPkg != "" {
+		return "-coverpkg=" + *coverPkg, nil
+	}
+	switch *coverScope {
+	case "packages":
+		return "-coverpkg=" + strings.Join(pkgs, ","), nil
+	case "package":
+		return "", nil
+	case "module":
+		cmd := exec.Command("go", "env", "GOMOD")
+		cmd.Dir = dir
+		out, err := cmd.Output()
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("cannot find the module: %v", err)
+		}
+		gomod := strings.TrimSpace(string(out))
+		if gomod == "" || gomod == os.DevNull {
+			return "", errors.New("-coverscope=module requires a module")
+		}
+		modPath := findRootPackage(filepath.Dir(gomod))
+		if modPath == "" {
+			return "", fmt.Errorf("cannot read the module path in %s", gomod)
+		}
+		return "-coverpkg=" + modPath + "/...", nil
+	}
+	return "", fmt.Errorf("unknown -coverscope %q", *coverScope)
+}
+
+// testArgs returns the command line of 'go test' writing the profile to
+// the file profile with the build tags, without the packages to test. If
+// json is true, the results are written as JSON events.
+func testArgs(profile, coverpkg, tags string, json bool) []string {
+	coverm := *covermode
+	if *race {
+		coverm = "atomic"
+	}
+	args := []string{"go", "test", "-covermode", coverm, "-coverprofile", profile}
+	if coverpkg != "" {
+		args = append(args, coverpkg)
+	}
+	if *verbose {
+		args = append(args, "-v")
+	}
+	if *race {
+		args = append(args, "-race")
+	}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	if json {
+		args = append(args, "-json")
+	}
+	return append(args, extraFlags...)
+}
+
+// runSingleTest runs the tests of all the packages of the module in dir
+// with the build tags with a single 'go test', which writes one profile of
+// all of them. With -continue-on-failure, the
+// packages whose tests failed are returned with the profile. If results
+// isn't nil, the results of the tests are added to it.
+func runSingleTest(dir, tags string, pkgs []string, coverpkg string, results *testResults) ([]*cover.Profile, []string, error) {
+	f, err := ioutil.TempFile("", "goveralls")
+	if err != nil {
+		return nil, nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmd := exec.Command("go")
+	cmd.Dir = dir
+	outBuf := new(bytes.Buffer)
+	out := &lockedWriter{w: outBuf}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if *verbose {
+		cmd.Stdout = io.MultiWriter(out, os.Stdout)
+	}
+	var tw *testJSONWriter
+	if results != nil {
+		tw = &testJSONWriter{w: cmd.Stdout, results: results}
+		cmd.Stdout = tw
+	}
+	cmd.Args = testArgs(f.Name(), coverpkg, tags, results != nil)
+	cmd.Args = append(cmd.Args, "-p", strconv.Itoa(jobCount()))
+	cmd.Args = append(cmd.Args, pkgs...)
+
+	if *show {
+		for _, pkg := range pkgs {
+			fmt.Println("goveralls:", pkg)
+		}
+	}
+	var failed []string
+	err = cmd.Run()
+	if tw != nil {
+		tw.flush()
+	}
+	if err != nil {
+		err = fmt.Errorf("%v: %v", err, outBuf.String())
+		if !*continueOnFailure {
+			return nil, nil, err
+		}
+		// 'go test' fails without running any test for bad flags.
+		failed = failedPkgs(outBuf.String())
+		if len(failed) == 0 {
+			return nil, nil, err
 		}
-		err = os.Remove(f.Name())
+		fmt.Fprintln(os.Stderr, "goveralls:", err)
+	}
+	profs, err := cover.ParseProfiles(f.Name())
+	return profs, failed, err
+}
+
+// failedPkgs returns the packages reported as failed in the output of
+// 'go test'.
+func failedPkgs(out string) []string {
+	var pkgs []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "FAIL" {
+			pkgs = append(pkgs, fields[1])
+		}
+	}
+	return pkgs
+}
+
+// useSingleTest reports whether the tests of all the packages are run by a
+// single 'go test', as selected by -testmode.
+func useSingleTest() (bool, error) {
+	switch *testMode {
+	case "single":
+		return true, nil
+	case "package":
+		return false, nil
+	case "auto":
+		major, minor, err := goVersion()
 		if err != nil {
-			return nil, err
+			return false, nil
 		}
-		pfss = append(pfss, pfs)
+		// 'go test' writes the profile of multiple packages since Go 1.10.
+		return major > 1 || (major == 1 && minor >= 10), nil
 	}
+	return false, fmt.Errorf("unknown -testmode %q", *testMode)
+}
+
+var goVersionRe = regexp.MustCompile(`go(\d+)\.(\d+)`)
 
-	sourceFiles, err := toSF(mergeProfs(pfss))
+// goVersion returns the major and minor version of the go command.
+func goVersion() (int, int, error) {
+	out, err := exec.Command("go", "version").Output()
 	if err != nil {
-		return nil, err
+		return 0, 0, err
+	}
+	m := goVersionRe.FindStringSubmatch(string(out))
+	if m == nil {
+		return 0, 0, fmt.Errorf("unknown go version: %s", out)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major, minor, nil
+}
+
+// jobCount returns the number of packages to test at once, at least 1.
+func jobCount() int {
+	if *jobs < 1 {
+		return 1
 	}
+	return *jobs
+}
+
+// runPkgTests calls run for each package of pkgs, up to -jobs at once.
+// report is called with the results in the order of pkgs, so that the
+// output and the merge of the profiles are deterministic. If report returns
+// an error, the remaining runs are canceled and the error is returned.
+func runPkgTests(pkgs []string, run func(ctx context.Context, pkg string) pkgTestResult, report func(pkg string, r pkgTestResult) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make([]chan pkgTestResult, len(pkgs))
+	for i := range results {
+		results[i] = make(chan pkgTestResult, 1)
+	}
+	queue := make(chan int)
+	go func() {
+		defer close(queue)
+		for i := range pkgs {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < jobCount(); w++ {
+		go func() {
+			for i := range queue {
+				results[i] <- run(ctx, pkgs[i])
+			}
+		}()
+	}
+
+	for i, pkg := range pkgs {
+		if err := report(pkg, <-results[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A pkgTestResult is the result of the tests of a package.
+type pkgTestResult struct {
+	profs  []*cover.Profile
+	stdout []byte
+	tests  *testResults // with -json only
+	err    error
+}
 
-	return sourceFiles, nil
+// lockedWriter serializes the writes of the goroutines copying the stdout
+// and the stderr of a command to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// A testFailureError reports the packages whose tests failed with
+// -continue-on-failure.
+type testFailureError struct {
+	pkgs []string
+}
+
+func (e *testFailureError) Error() string {
+	return "tests failed in packages:\n  " + strings.Join(e.pkgs, "\n  ")
+}
+
+// runPkgTest runs the tests of the package pkg of the module in dir with
+// the build tags and parses its profile. If json is true, the results of
+// the tests are decoded too.
+func runPkgTest(ctx context.Context, dir, tags, pkg, coverpkg string, json bool) pkgTestResult {
+	f, err := ioutil.TempFile("", "goveralls")
+	if err != nil {
+		return pkgTestResult{err: err}
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmd := exec.CommandContext(ctx, "go")
+	cmd.Dir = dir
+	outBuf := new(bytes.Buffer)
+	out := &lockedWriter{w: outBuf}
+	stdout := new(bytes.Buffer)
+	cmd.Stdout = io.MultiWriter(out, stdout)
+	cmd.Stderr = out
+	var tw *testJSONWriter
+	if json {
+		tw = &testJSONWriter{w: cmd.Stdout, results: newTestResults()}
+		cmd.Stdout = tw
+	}
+	cmd.Args = append(testArgs(f.Name(), coverpkg, tags, json), pkg)
+
+	err = cmd.Run()
+	var tests *testResults
+	if tw != nil {
+		tw.flush()
+		tests = tw.results
+	}
+	if err != nil {
+		// The profile is written even if the tests fail.
+		pfs, _ := cover.ParseProfiles(f.Name())
+		return pkgTestResult{profs: pfs, stdout: stdout.Bytes(), tests: tests, err: fmt.Errorf("%v: %v", err, outBuf.String())}
+	}
+
+	pfs, err := cover.ParseProfiles(f.Name())
+	if err != nil {
+		return pkgTestResult{stdout: stdout.Bytes(), tests: tests, err: err}
+	}
+	return pkgTestResult{profs: pfs, stdout: stdout.Bytes(), tests: tests}
 }
 
 var vscDirs = []string{".git", ".hg", ".bzr", ".svn"}
@@ -238,7 +646,7 @@ func getCoverallsSourceFileName(name string) string {
 
 // processParallelFinish notifies coveralls that all jobs are completed
 // ref. https://docs.coveralls.io/parallel-build-webhook
-func processParallelFinish(jobID, token string) error {
+func processParallelFinish(client *coveralls.Client, jobID string) error {
 	var name string
 	if reponame != nil && *reponame != "" {
 		name = *reponame
@@ -246,60 +654,33 @@ func processParallelFinish(jobID, token string) error {
 		name = s
 	}
 
-	params := make(url.Values)
-	params.Set("repo_token", token)
-	if name != "" {
-		params.Set("repo_name", name)
-	}
-	params.Set("payload[build_num]", jobID)
-	params.Set("payload[status]", "done")
-	res, err := http.PostForm(*endpoint+"/webhook", params)
-	if *debug {
-		if token != "" {
-			params.Set("repo_token", "*******")
-		}
-		log.Printf("Posted webhook data: %q", params.Encode())
-	}
-
+	response, err := client.FinishParallel(context.Background(), jobID, name)
 	if err != nil {
-		return err
+		return shallowError(err)
 	}
-	defer res.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("unable to read response body from coveralls: %s", err)
+	if !response.Done {
+		return fmt.Errorf("jobs are not completed:\n%s", response.Body)
 	}
 
-	if *shallow {
-		if res.StatusCode >= http.StatusInternalServerError {
-			fmt.Println("coveralls server failed internally")
-			return nil
-		}
-
-		// XXX: It looks that Coveralls is under maintenance.
-		// Coveralls serves the maintenance page as a static HTML hosting,
-		// and the maintenance page doesn't accept POST method.
-		// See https://github.com/mattn/goveralls/issues/204
-		if res.StatusCode == http.StatusMethodNotAllowed {
-			fmt.Println("it looks that Coveralls is under maintenance. visit https://status.coveralls.io/")
-			return nil
-		}
-	}
+	return nil
+}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad response status from coveralls: %d\n%s", res.StatusCode, bodyBytes)
+// shallowError swallows the errors of the coveralls server when -shallow
+// is given.
+func shallowError(err error) error {
+	var apiErr *coveralls.APIError
+	if !*shallow || !errors.As(err, &apiErr) {
+		return err
 	}
-
-	var response WebHookResponse
-	if err = json.Unmarshal(bodyBytes, &response); err != nil {
-		return fmt.Errorf("unable to unmarshal response JSON from coveralls: %s\n%s", err, bodyBytes)
+	if apiErr.ServerError() {
+		fmt.Println("coveralls server failed internally")
+		return nil
 	}
-
-	if !response.Done {
-		return fmt.Errorf("jobs are not completed:\n%s", bodyBytes)
+	if apiErr.Maintenance() {
+		fmt.Println("it looks that Coveralls is under maintenance. visit https://status.coveralls.io/")
+		return nil
 	}
-
-	return nil
+	return err
 }
 
 func process() error {
@@ -336,39 +717,37 @@ func process() error {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	if *coveredByLine != "" {
+		if *testMapFile == "" {
+			return errors.New("-coveredby requires -testmap")
+		}
+		m, err := readTestMap(*testMapFile)
+		if err != nil {
+			return err
+		}
+		return coveredBy(os.Stdout, m, *coveredByLine)
+	}
+	if *testMapFile != "" {
+		return buildTestMap(*testMapFile)
+	}
+
 	//
 	// Initialize Job
 	//
 
+	// the pull request isn't needed to finish a parallel build or to upload
+	// a saved job, so an error reading it is returned after those.
+	ci, ciErr := coveralls.DetectCI(os.Getenv)
+	if ci == nil {
+		return ciErr
+	}
+
 	// flags are never nil, so no nil check needed
-	githubEvent := getGithubEvent()
-	var jobID string
+	jobID := ci.JobID
 	if *customJobID != "" {
 		jobID = *customJobID
 	} else if ServiceJobID := os.Getenv("COVERALLS_SERVICE_JOB_ID"); ServiceJobID != "" {
 		jobID = ServiceJobID
-	} else if travisjobID := os.Getenv("TRAVIS_JOB_ID"); travisjobID != "" {
-		jobID = travisjobID
-	} else if circleCIJobID := os.Getenv("CIRCLE_BUILD_NUM"); circleCIJobID != "" {
-		jobID = circleCIJobID
-	} else if appveyorJobID := os.Getenv("APPVEYOR_JOB_ID"); appveyorJobID != "" {
-		jobID = appveyorJobID
-	} else if semaphorejobID := os.Getenv("SEMAPHORE_BUILD_NUMBER"); semaphorejobID != "" {
-		jobID = semaphorejobID
-	} else if jenkinsjobID := os.Getenv("BUILD_NUMBER"); jenkinsjobID != "" {
-		jobID = jenkinsjobID
-	} else if buildID := os.Getenv("BUILDKITE_BUILD_ID"); buildID != "" {
-		jobID = buildID
-	} else if droneBuildNumber := os.Getenv("DRONE_BUILD_NUMBER"); droneBuildNumber != "" {
-		jobID = droneBuildNumber
-	} else if buildkiteBuildNumber := os.Getenv("BUILDKITE_BUILD_NUMBER"); buildkiteBuildNumber != "" {
-		jobID = buildkiteBuildNumber
-	} else if codeshipjobID := os.Getenv("CI_BUILD_ID"); codeshipjobID != "" {
-		jobID = codeshipjobID
-	} else if githubRunID := os.Getenv("GITHUB_RUN_ID"); githubRunID != "" {
-		jobID = githubRunID
-	} else if gitlabRunID := os.Getenv("CI_PIPELINE_ID"); gitlabRunID != "" {
-		jobID = gitlabRunID
 	}
 
 	if *repotoken == "" && *repotokenfile != "" {
@@ -379,77 +758,99 @@ func process() error {
 		*repotoken = strings.TrimSpace(string(tokenBytes))
 	}
 
+	client := coveralls.NewClient(*endpoint, *repotoken)
+	client.MaxRetries = *retries
+	client.RetryWait = *retryWait
+	if *debug {
+		client.Logger = log.New(os.Stderr, "", log.Flags())
+	}
+
 	if *parallelFinish {
-		return processParallelFinish(jobID, *repotoken)
+		return processParallelFinish(client, jobID)
+	}
+
+	if *flagPerModule && *saveJob != "" {
+		return errors.New("-flagpermodule can't be combined with -savejob")
 	}
 
-	if *repotoken == "" {
-		repotoken = nil // remove the entry from json
+	if *uploadJob != "" {
+		j, err := readJob(*uploadJob)
+		if err != nil {
+			return err
+		}
+		return submitJob(client, j)
+	}
+	if ciErr != nil {
+		return ciErr
 	}
 
+	if *service == "" {
+		*service = ci.ServiceName
+	}
+	if *jobNumber == "" {
+		*jobNumber = ci.JobNumber
+	}
 	head := "HEAD"
-	var pullRequest string
-	if prNumber := os.Getenv("CIRCLE_PR_NUMBER"); prNumber != "" {
-		// for Circle CI (pull request from forked repo)
-		pullRequest = prNumber
-	} else if prURL := os.Getenv("CIRCLE_PULL_REQUEST"); prURL != "" {
-		// for Circle CI (all other pull requests)
-		pullRequest = regexp.MustCompile(`[0-9]+$`).FindString(prURL)
-	} else if prNumber := os.Getenv("TRAVIS_PULL_REQUEST"); prNumber != "" && prNumber != "false" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("APPVEYOR_PULL_REQUEST_NUMBER"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("PULL_REQUEST_NUMBER"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("BUILDKITE_PULL_REQUEST"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("DRONE_PULL_REQUEST"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("BUILDKITE_PULL_REQUEST"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("CI_PR_NUMBER"); prNumber != "" {
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("CHANGE_ID"); prNumber != "" {
-		// for Jenkins multibranch projects
-		pullRequest = prNumber
-	} else if prURL := os.Getenv("CHANGE_URL"); prURL != "" {
-		// for Jenkins multibranch projects
-		pullRequest = regexp.MustCompile(`[0-9]+$`).FindString(prURL)
-	} else if prURL := os.Getenv("CI_PULL_REQUEST"); prURL != "" {
-		// for Circle CI
-		pullRequest = regexp.MustCompile(`[0-9]+$`).FindString(prURL)
-	} else if os.Getenv("GITHUB_EVENT_NAME") == "pull_request" {
-		number := githubEvent["number"].(float64)
-		pullRequest = strconv.Itoa(int(number))
-
-		ghPR := githubEvent["pull_request"].(map[string]interface{})
-		ghHead := ghPR["head"].(map[string]interface{})
-		head = ghHead["sha"].(string)
-	} else if prNumber := os.Getenv("CI_MERGE_REQUEST_IID"); prNumber != "" {
-		// pull request id from GitHub when building on GitLab
-		pullRequest = prNumber
-	} else if prNumber := os.Getenv("CI_EXTERNAL_PULL_REQUEST_IID"); prNumber != "" {
-		pullRequest = prNumber
-	}
-
-	if *service == "" && os.Getenv("TRAVIS_JOB_ID") != "" {
-		*service = "travis-ci"
-	}
-
-	sourceFiles, err := getCoverage()
+	if ci.HeadRef != "" {
+		head = ci.HeadRef
+	}
+
+	var err error
+	var thresholds []coverageThreshold
+	if *minCoverageFile != "" {
+		if *coverImport != "" {
+			// the imported files have no import path to match the packages
+			return errors.New("-min-coverage-file cannot be used with -coverimport")
+		}
+		thresholds, err = readThresholds(*minCoverageFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var results *testResults
+	if *testJSON != "" {
+		results, err = readTestJSON(*testJSON)
+		if err != nil {
+			return fmt.Errorf("cannot read test results: %v", err)
+		}
+	}
+	var runResults *testResults
+	if *testSummary && results == nil {
+		runResults = newTestResults()
+		results = runResults
+	}
+	profs, failed, err := getCoverage(runResults)
+	if err != nil {
+		return err
+	}
+	sourceFiles, err := toSF(profs)
 	if err != nil {
 		return err
 	}
+	if *coverImport != "" {
+		imported, err := importCoverage(*coverImport)
+		if err != nil {
+			return err
+		}
+		sourceFiles = mergeSourceFiles(sourceFiles, imported)
+	}
+	// the job is uploaded even if the coverage is below the minimum.
+	coverageErr := evalCoverage(profs, *minCoverage, thresholds)
+	if *coverImport != "" {
+		// the imported reports count lines, not statements
+		coverageErr = evalLineCoverage(sourceFiles, *minCoverage)
+	}
 
-	gitInfo, err := collectGitInfo(head)
+	gitInfo, err := collectGitInfo(head, ci.Branch)
 	if err != nil {
 		return err
 	}
 
 	j := Job{
 		RunAt:              time.Now(),
-		RepoToken:          repotoken,
-		ServicePullRequest: pullRequest,
+		ServicePullRequest: ci.PullRequest,
+		ServiceBuildURL:    ci.BuildURL,
 		Parallel:           parallel,
 		Git:                gitInfo,
 		SourceFiles:        sourceFiles,
@@ -488,94 +889,100 @@ func process() error {
 		j.SourceFiles = files
 	}
 
-	if *debug {
-		j := j
-		if j.RepoToken != nil && *j.RepoToken != "" {
-			s := "*******"
-			j.RepoToken = &s
-		}
-		b, err := json.MarshalIndent(j, "", "  ")
-		if err != nil {
-			return err
-		}
-		log.Printf("Posting data: %s", b)
+	if *summary {
+		printSummary(os.Stdout, j.SourceFiles, *summaryLimit)
 	}
-
-	b, err := json.Marshal(j)
-	if err != nil {
-		return err
+	if results != nil {
+		printTestSummary(os.Stdout, results, profs)
 	}
-
-	params := make(url.Values)
-	params.Set("json", string(b))
-	res, err := http.PostForm(*endpoint+"/api/v1/jobs", params)
-	if err != nil {
-		return err
+	if *htmlReport != "" {
+		if err := writeHTMLReport(*htmlReport, j.SourceFiles); err != nil {
+			return fmt.Errorf("cannot write HTML report: %v", err)
+		}
 	}
-	defer res.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("unable to read response body from coveralls: %s", err)
+	if err := writeReports(j.SourceFiles); err != nil {
+		return err
 	}
 
-	if *shallow {
-		if res.StatusCode >= http.StatusInternalServerError {
-			fmt.Println("coveralls server failed internally")
-			return nil
+	if *saveJob != "" {
+		if err := writeJob(*saveJob, &j); err != nil {
+			return err
 		}
-
-		// XXX: It looks that Coveralls is under maintenance.
-		// Coveralls serves the maintenance page as a static HTML hosting,
-		// and the maintenance page doesn't accept POST method.
-		// See https://github.com/mattn/goveralls/issues/204
-		if res.StatusCode == http.StatusMethodNotAllowed {
-			fmt.Println("it looks that Coveralls is under maintenance. visit https://status.coveralls.io/")
-			return nil
+	} else if *upload {
+		jobs := []*Job{&j}
+		if *flagPerModule {
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			mods, err := findModules(wd, *multiModule)
+			if err != nil {
+				return fmt.Errorf("cannot find modules: %v", err)
+			}
+			jobs = splitJobByModule(&j, mods)
+		}
+		for _, j := range jobs {
+			if err := submitJob(client, j); err != nil {
+				return err
+			}
 		}
 	}
-
-	if res.StatusCode != 200 {
-		return fmt.Errorf("bad response status from coveralls: %d\n%s", res.StatusCode, bodyBytes)
-	}
-	var response Response
-	if err = json.Unmarshal(bodyBytes, &response); err != nil {
-		return fmt.Errorf("unable to unmarshal response JSON from coveralls: %s\n%s", err, bodyBytes)
+	if len(failed) > 0 {
+		if coverageErr != nil {
+			fmt.Fprintln(os.Stderr, coverageErr)
+		}
+		return &testFailureError{pkgs: failed}
 	}
-	if response.Error {
-		return errors.New(response.Message)
+	return coverageErr
+}
+
+// submitJob posts the job to coveralls and shows the response.
+func submitJob(client *coveralls.Client, j *Job) error {
+	response, err := client.SubmitJob(context.Background(), j)
+	if err != nil {
+		return shallowError(err)
 	}
 	fmt.Println(response.Message)
 	fmt.Println(response.URL)
 	return nil
 }
 
-func getGithubEvent() map[string]interface{} {
-	jsonFilePath := os.Getenv("GITHUB_EVENT_PATH")
-	if jsonFilePath == "" {
-		return nil
-	}
-
-	jsonFile, err := os.Open(jsonFilePath)
+// writeJob writes the job to the JSON file path. The repository token
+// isn't written, so that the file can be passed to an untrusted step.
+func writeJob(path string, j *Job) error {
+	j2 := *j
+	j2.RepoToken = nil
+	b, err := json.MarshalIndent(j2, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer jsonFile.Close()
-
-	jsonByte, _ := ioutil.ReadAll(jsonFile)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("cannot write job: %v", err)
+	}
+	fmt.Printf("job written to %s\n", path)
+	return nil
+}
 
-	// unmarshal the json into a release event
-	var event map[string]interface{}
-	err = json.Unmarshal(jsonByte, &event)
+// readJob reads the job from the JSON file path written by writeJob.
+func readJob(path string) (*Job, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cannot read job: %v", err)
 	}
-
-	return event
+	var j Job
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, fmt.Errorf("cannot parse job %q: %v", path, err)
+	}
+	return &j, nil
 }
 
 func main() {
 	if err := process(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
+		var coverageErr *coverageError
+		if errors.As(err, &coverageErr) {
+			os.Exit(3)
+		}
 		os.Exit(1)
 	}
 }
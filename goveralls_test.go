@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"net/http"
 	"net/http/httptest"
@@ -220,8 +225,550 @@ func TestUploadSource(t *testing.T) {
 			if len(sf.Source) != 0 {
 				t.Fatalf("expected source for %q to be empty", sf.Name)
 			}
+			if len(sf.SourceDigest) != 32 {
+				t.Fatalf("expected MD5 digest of source for %q, but got %q", sf.Name, sf.SourceDigest)
+			}
+		}
+	})
+}
+
+func TestSaveAndUploadJob(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls_job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jobFile := filepath.Join(dir, "job.json")
+
+	b, err := testRun("-savejob", jobFile, "-jobid=123abc", "-repotoken=secret", "-package=github.com/mattn/goveralls/tester", "-endpoint", "http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	saved, err := ioutil.ReadFile(jobFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "secret") {
+		t.Error("Expected the saved job not to contain the repository token", string(saved))
+	}
+
+	jobBodyChannel := make(chan Job, 16)
+	fs := fakeServerWithPayloadChannel(jobBodyChannel)
+
+	b, err = testRun("-uploadjob", jobFile, "-repotoken=secret", "-endpoint", fs.URL)
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+
+	jobBody := <-jobBodyChannel
+	if jobBody.ServiceJobID != "123abc" {
+		t.Errorf("Expected job id of 123abc, but was %s", jobBody.ServiceJobID)
+	}
+	if jobBody.RepoToken == nil || *jobBody.RepoToken != "secret" {
+		t.Errorf("Expected the repository token to be sent on upload, but was %v", jobBody.RepoToken)
+	}
+	if len(jobBody.SourceFiles) == 0 {
+		t.Error("Expected the saved source files to be sent")
+	}
+}
+
+func TestMinCoverage(t *testing.T) {
+	t.Parallel()
+
+	fs := fakeServer()
+
+	b, err := testRun("-package=github.com/mattn/goveralls/tester", "-min-coverage=100", "-endpoint", fs.URL)
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+
+	jobBodyChannel := make(chan Job, 16)
+	fs = fakeServerWithPayloadChannel(jobBodyChannel)
+	b, err = testRun("-package=github.com/mattn/goveralls/tester", "-min-coverage=100.1", "-endpoint", fs.URL)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatal("Expected exit code 3", err, string(b))
+	}
+	if !strings.Contains(string(b), "total: 100.0% < 100.1%") {
+		t.Error("Expected the report of the failed minimum", string(b))
+	}
+	// the job is uploaded regardless
+	<-jobBodyChannel
+}
+
+func TestTestMode(t *testing.T) {
+	t.Parallel()
+
+	coverage := make(map[string][]interface{})
+	for _, mode := range []string{"single", "package"} {
+		jobBodyChannel := make(chan Job, 16)
+		fs := fakeServerWithPayloadChannel(jobBodyChannel)
+
+		b, err := testRun("-testmode="+mode, "-package=github.com/mattn/goveralls/tester/...", "-show", "-endpoint", fs.URL)
+		if err != nil {
+			t.Fatal("Expected exit code 0 got 1", err, string(b))
+		}
+		if !strings.HasPrefix(string(b), "goveralls: github.com/mattn/goveralls/tester\n") {
+			t.Errorf("%s: unexpected output for -show: %s", mode, b)
+		}
+		jobBody := <-jobBodyChannel
+		for _, sf := range jobBody.SourceFiles {
+			coverage[mode] = append(coverage[mode], sf.Name, sf.Coverage)
+		}
+	}
+	if !reflect.DeepEqual(coverage["single"], coverage["package"]) {
+		t.Errorf("expected the same coverage in both modes, but got %v and %v", coverage["single"], coverage["package"])
+	}
+
+	b, err := testRun("-testmode=bogus", "-package=github.com/mattn/goveralls/tester", "-upload=false")
+	if err == nil || !strings.Contains(string(b), `unknown -testmode "bogus"`) {
+		t.Error("Expected an error for an unknown -testmode", err, string(b))
+	}
+
+	// -jobs below 1 tests one package at a time in both modes
+	for _, mode := range []string{"single", "package"} {
+		b, err := testRun("-testmode="+mode, "-jobs=0", "-package=github.com/mattn/goveralls/tester", "-upload=false")
+		if err != nil {
+			t.Errorf("%s: expected -jobs=0 to work: %v: %s", mode, err, b)
+		}
+	}
+}
+
+func TestContinueOnFailure(t *testing.T) {
+	t.Parallel()
+
+	pkgs := "-package=github.com/mattn/goveralls/tester github.com/mattn/goveralls/testdata/failing"
+	for _, mode := range []string{"single", "package"} {
+		b, err := testRun("-testmode="+mode, pkgs, "-upload=false")
+		if err == nil {
+			t.Fatalf("%s: expected the failing tests to fail goveralls: %s", mode, b)
+		}
+
+		jobBodyChannel := make(chan Job, 16)
+		fs := fakeServerWithPayloadChannel(jobBodyChannel)
+		b, err = testRun("-testmode="+mode, pkgs, "-continue-on-failure", "-endpoint", fs.URL)
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			t.Fatalf("%s: expected exit code 1: %v: %s", mode, err, b)
+		}
+		if !strings.Contains(string(b), "tests failed in packages:\n  github.com/mattn/goveralls/testdata/failing\n") {
+			t.Errorf("%s: expected the report of the failed package: %s", mode, b)
+		}
+		// the job is uploaded with the coverage of both packages
+		jobBody := <-jobBodyChannel
+		var names []string
+		for _, sf := range jobBody.SourceFiles {
+			names = append(names, sf.Name)
+		}
+		want := []string{"testdata/failing/failing.go", "tester/tester.go"}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: expected the source files %v, but got %v", mode, want, names)
+		}
+	}
+}
+
+func TestTestSummaryFlag(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"single", "package"} {
+		b, err := testRun("-testmode="+mode, "-package=github.com/mattn/goveralls/tester", "-testsummary", "-upload=false")
+		if err != nil {
+			t.Fatal("Expected exit code 0 got 1", err, string(b))
+		}
+		if !regexp.MustCompile(`github.com/mattn/goveralls/tester +1 +0 +0 +[0-9.]+s +100.0%`).Match(b) {
+			t.Errorf("%s: expected the results of the tests in the summary: %s", mode, b)
+		}
+	}
+}
+
+func TestMultiModule(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		".git/HEAD":     "",
+		"go.mod":        "module example.com/root\n\ngo 1.13\n",
+		"a/a.go":        "package a\n\nfunc A() int {\n\treturn 1\n}\n",
+		"a/a_test.go":   "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) { A() }\n",
+		"sub/go.mod":    "module example.com/sub\n\ngo 1.13\n",
+		"sub/b.go":      "package sub\n\nfunc B() int {\n\treturn 2\n}\n",
+		"sub/b_test.go": "package sub\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {}\n",
+	})
+
+	cmd := exec.Command(goverallsTestBin, "-allowgitfetch=false", "-multimodule", "-summary", "-upload=false")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	for _, want := range []string{`a/a.go +2 +2 +100.0%`, `sub/b.go +0 +2 +0.0%`} {
+		if !regexp.MustCompile(want).Match(b) {
+			t.Errorf("expected %q in the summary: %s", want, b)
+		}
+	}
+
+	// the test map covers the tests of every module too
+	cmd = exec.Command(goverallsTestBin, "-multimodule", "-testmap=testmap.json")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=-mod=mod")
+	b, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	m, err := readTestMap(filepath.Join(dir, "testmap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Files["a/a.go"][4]; !reflect.DeepEqual(got, []string{"example.com/root/a.TestA"}) {
+		t.Errorf("unexpected tests of a/a.go:4: %v", got)
+	}
+	if _, ok := m.Files["sub/b.go"]; ok {
+		t.Errorf("expected no tests covering sub/b.go: %v", m.Files)
+	}
+	if !strings.Contains(string(b), "test map of 2 tests") {
+		t.Errorf("expected the tests of both modules to run: %s", b)
+	}
+}
+
+func TestParallelFinishGitHubEventError(t *testing.T) {
+	t.Parallel()
+
+	buildNum := make(chan string, 1)
+	fs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buildNum <- r.FormValue("payload[build_num]")
+		fmt.Fprintln(w, `{"done":true}`)
+	}))
+	defer fs.Close()
+
+	// the pull request of the unreadable event isn't needed to finish the build
+	cmd := exec.Command(goverallsTestBin, "-allowgitfetch=false", "-parallel-finish", "-endpoint", fs.URL)
+	cmd.Env = append(os.Environ(),
+		"GITHUB_ACTIONS=true",
+		"GITHUB_RUN_ID=42",
+		"GITHUB_EVENT_NAME=pull_request",
+		"GITHUB_EVENT_PATH="+filepath.Join("testdata", "no-such-event.json"),
+	)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if got := <-buildNum; got != "42" {
+		t.Errorf("expected the build 42 to be finished, but got %q", got)
+	}
+}
+
+func TestTestMapFlag(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	b, err := testRun("-testmap", f.Name(), "-package=github.com/mattn/goveralls/tester")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	b, err = testRun("-testmap", f.Name(), "-coveredby", "tester/tester.go:10")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if got, want := string(b), "github.com/mattn/goveralls/tester.TestSimple\n"; got != want {
+		t.Errorf("expected the tests covering the line %q, but got %q", want, got)
+	}
+
+	// the tests of every set of tags are run
+	b, err = testRun("-testmap", f.Name(), "-package=github.com/mattn/goveralls/testdata/tagged", "-tagset=", "-tagset=extra")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	b, err = testRun("-testmap", f.Name(), "-coveredby", "testdata/tagged/extra.go:8")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if got, want := string(b), "github.com/mattn/goveralls/testdata/tagged.TestExtra\n"; got != want {
+		t.Errorf("expected the tests covering the line %q, but got %q", want, got)
+	}
+	b, err = testRun("-testmap", f.Name(), "-coveredby", "testdata/tagged/tagged.go:5")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if got, want := string(b), "github.com/mattn/goveralls/testdata/tagged.TestPlain\n"; got != want {
+		t.Errorf("expected the tests covering the line %q once, but got %q", want, got)
+	}
+}
+
+func TestCoverScope(t *testing.T) {
+	t.Parallel()
+
+	for _, args := range [][]string{
+		{"-coverscope=packages"},
+		{"-coverscope=package"},
+		{"-coverscope=module"},
+		{"-coverpkg=github.com/mattn/goveralls/tester,github.com/mattn/goveralls/coveralls"},
+	} {
+		args = append(args, "-package=github.com/mattn/goveralls/tester", "-summary", "-upload=false")
+		b, err := testRun(args...)
+		if err != nil {
+			t.Fatal("Expected exit code 0 got 1", err, string(b))
+		}
+		if !regexp.MustCompile(`tester/tester.go +5 +5 +100.0%`).Match(b) {
+			t.Errorf("%s: expected the coverage of tester in the summary: %s", args[0], b)
+		}
+	}
+
+	b, err := testRun("-coverscope=bogus", "-package=github.com/mattn/goveralls/tester", "-upload=false")
+	if err == nil || !strings.Contains(string(b), `unknown -coverscope "bogus"`) {
+		t.Error("Expected an error for an unknown -coverscope", err, string(b))
+	}
+}
+
+func TestTagSets(t *testing.T) {
+	t.Parallel()
+
+	b, err := testRun("-package=github.com/mattn/goveralls/testdata/tagged", "-summary", "-upload=false")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if strings.Contains(string(b), "extra.go") {
+		t.Errorf("expected no coverage of the files of the extra tag: %s", b)
+	}
+
+	b, err = testRun("-package=github.com/mattn/goveralls/testdata/tagged", "-tagset=", "-tagset=extra", "-summary", "-upload=false")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	for _, want := range []string{
+		`goveralls: tags "": 1 of 1 statements covered \(100.0%\)`,
+		`goveralls: tags "extra": 2 of 2 statements covered \(100.0%\)`,
+		`testdata/tagged/extra.go +2 +2 +100.0%`,
+		`testdata/tagged/tagged.go +2 +2 +100.0%`,
+	} {
+		if !regexp.MustCompile(want).Match(b) {
+			t.Errorf("expected %q in the output: %s", want, b)
 		}
+	}
+}
+
+func TestStrictModes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"set.out":   "mode: set\ngithub.com/mattn/goveralls/tester/tester.go:7.35,9.13 2 1\n",
+		"count.out": "mode: count\ngithub.com/mattn/goveralls/tester/tester.go:7.35,9.13 2 3\n",
 	})
+	profiles := "-coverprofile=" + filepath.Join(dir, "set.out") + "," + filepath.Join(dir, "count.out")
+
+	b, err := testRun(profiles, "-upload=false")
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if !strings.Contains(string(b), "warning: merging profiles of cover modes count, set in set mode") {
+		t.Errorf("expected a warning about the cover modes: %s", b)
+	}
+
+	b, err = testRun(profiles, "-strict", "-upload=false")
+	if err == nil || !strings.Contains(string(b), "cannot merge profiles of cover modes count, set") {
+		t.Error("Expected an error for the cover modes with -strict", err, string(b))
+	}
+}
+
+func TestCoverImport(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"count.out": "mode: count\ngithub.com/mattn/goveralls/tester/tester.go:7.35,9.13 2 3\n",
+		"lcov.info": "TN:\nSF:tester/tester.go\nDA:8,2\nDA:12,1\nend_of_record\n",
+	})
+
+	jobBodyChannel := make(chan Job, 16)
+	fs := fakeServerWithPayloadChannel(jobBodyChannel)
+	b, err := testRun("-coverprofile="+filepath.Join(dir, "count.out"), "-coverimport="+filepath.Join(dir, "lcov.info"), "-repotoken=secret", "-endpoint", fs.URL)
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	if !strings.Contains(string(b), "goveralls: importing report "+filepath.Join(dir, "lcov.info")) {
+		t.Errorf("expected the imported report to be logged: %s", b)
+	}
+
+	jobBody := <-jobBodyChannel
+	if len(jobBody.SourceFiles) != 1 || jobBody.SourceFiles[0].Name != "tester/tester.go" {
+		t.Fatalf("unexpected source files: %v", jobBody.SourceFiles)
+	}
+	// the hits are decoded from JSON
+	cov := jobBody.SourceFiles[0].Coverage
+	if len(cov) != 12 || cov[7] != 5.0 || cov[8] != 3.0 || cov[9] != nil || cov[11] != 1.0 {
+		t.Errorf("unexpected coverage: %v", cov)
+	}
+}
+
+func TestCoverImportMinCoverage(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"lcov.info": "TN:\nSF:tester/tester.go\nDA:8,0\nDA:12,0\nend_of_record\n",
+		"minimums":  "github.com/mattn/goveralls/... 50\n",
+	})
+	lcov := "-coverimport=" + filepath.Join(dir, "lcov.info")
+
+	b, err := testRun(lcov, "-min-coverage=90", "-upload=false")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatal("Expected exit code 3", err, string(b))
+	}
+	if !strings.Contains(string(b), "total: 0.0% < 90.0%") {
+		t.Error("Expected the report of the failed minimum", string(b))
+	}
+
+	b, err = testRun(lcov, "-min-coverage-file="+filepath.Join(dir, "minimums"), "-upload=false")
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || !strings.Contains(string(b), "cannot be used with -coverimport") {
+		t.Error("Expected -min-coverage-file to be rejected", err, string(b))
+	}
+}
+
+func TestReportOutputs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputs := map[string]string{
+		"-lcovout":      "SF:tester/tester.go",
+		"-coberturaout": `filename="tester/tester.go"`,
+		"-sonarout":     `<file path="tester/tester.go">`,
+	}
+	args := []string{"-package=github.com/mattn/goveralls/tester", "-upload=false"}
+	for flag := range outputs {
+		args = append(args, flag, filepath.Join(dir, flag[1:]))
+	}
+	b, err := testRun(args...)
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+	for flag, want := range outputs {
+		out, err := ioutil.ReadFile(filepath.Join(dir, flag[1:]))
+		if err != nil {
+			t.Errorf("%s: %v", flag, err)
+			continue
+		}
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%s: expected %s in the report:\n%s", flag, want, out)
+		}
+	}
+}
+
+func TestLineModeStatements(t *testing.T) {
+	t.Parallel()
+
+	jobBodyChannel := make(chan Job, 16)
+	fs := fakeServerWithPayloadChannel(jobBodyChannel)
+	b, err := testRun("-package=github.com/mattn/goveralls/tester", "-linemode=statements", "-endpoint", fs.URL)
+	if err != nil {
+		t.Fatal("Expected exit code 0 got 1", err, string(b))
+	}
+
+	jobBody := <-jobBodyChannel
+	for _, sf := range jobBody.SourceFiles {
+		if sf.Name != "tester/tester.go" {
+			continue
+		}
+		// only the lines 8 to 10 and 12 hold statements
+		for i, c := range sf.Coverage {
+			line := i + 1
+			stmt := line >= 8 && line <= 10 || line == 12
+			if (c != nil) != stmt {
+				t.Errorf("unexpected coverage %v of line %d", c, line)
+			}
+		}
+		return
+	}
+	t.Errorf("expected the coverage of tester/tester.go: %v", jobBody.SourceFiles)
+}
+
+func TestFailedPkgs(t *testing.T) {
+	t.Parallel()
+
+	out := `ok  	example.com/a	0.003s	coverage: 33.3% of statements
+--- FAIL: TestF (0.00s)
+    b_test.go:3: x
+FAIL
+coverage: 33.3% of statements
+FAIL	example.com/b	0.005s
+FAIL	example.com/c [build failed]
+FAIL
+`
+	want := []string{"example.com/b", "example.com/c"}
+	if got := failedPkgs(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("failedPkgs() = %v, want %v", got, want)
+	}
+}
+
+func TestRunPkgTests(t *testing.T) {
+	t.Parallel()
+
+	pkgs := []string{"a", "b", "c", "d", "e"}
+	var reported []string
+	err := runPkgTests(pkgs, func(ctx context.Context, pkg string) pkgTestResult {
+		// finish the later packages first
+		time.Sleep(time.Duration('e'-pkg[0]) * 10 * time.Millisecond)
+		return pkgTestResult{stdout: []byte(pkg)}
+	}, func(pkg string, r pkgTestResult) error {
+		if string(r.stdout) != pkg {
+			t.Errorf("expected the result of %s, but got %s", pkg, r.stdout)
+		}
+		reported = append(reported, pkg)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reported, pkgs) {
+		t.Errorf("expected results in the order of %v, but got %v", pkgs, reported)
+	}
+
+	wantErr := errors.New("test failed")
+	reported = nil
+	err = runPkgTests(pkgs, func(ctx context.Context, pkg string) pkgTestResult {
+		if pkg == "b" {
+			return pkgTestResult{err: wantErr}
+		}
+		return pkgTestResult{}
+	}, func(pkg string, r pkgTestResult) error {
+		reported = append(reported, pkg)
+		return r.err
+	})
+	if err != wantErr {
+		t.Errorf("expected %v, but got %v", wantErr, err)
+	}
+	if !reflect.DeepEqual(reported, []string{"a", "b"}) {
+		t.Errorf("expected to stop at the failed package, but reported %v", reported)
+	}
 }
 
 func testRun(args ...string) ([]byte, error) {
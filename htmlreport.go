@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage report</title>
+<style>` + reportStyle + `</style>
+</head>
+<body>
+<h1>Coverage report</h1>
+<p>Total: {{.Total.Covered}} of {{.Total.Lines}} lines covered ({{printf "%.1f" .Total.Percent}}%)</p>
+<table>
+<tr><th>Package / File</th><th>Covered</th><th>Lines</th><th>Coverage</th></tr>
+{{range .Packages}}<tr class="package"><td>{{.Name}}</td><td>{{.Covered}}</td><td>{{.Lines}}</td><td>{{template "bar" .Percent}}</td></tr>
+{{range .Files}}<tr class="file"><td><a href="{{.Link}}">{{.Base}}</a></td><td>{{.Covered}}</td><td>{{.Lines}}</td><td>{{template "bar" .Percent}}</td></tr>
+{{end}}{{end}}</table>
+</body>
+</html>
+{{define "bar"}}<span class="bar"><span style="width: {{printf "%.0f" .}}%"></span></span> {{printf "%.1f" .}}%{{end}}
+`))
+
+var fileTemplate = template.Must(template.New("file").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>` + reportStyle + `</style>
+</head>
+<body>
+<h1><a href="{{.Index}}">Coverage report</a> / {{.Name}}</h1>
+<p>{{.Covered}} of {{.Lines}} lines covered ({{printf "%.1f" .Percent}}%)</p>
+<table class="source">
+{{range .Source}}<tr class="{{.Class}}"><td class="num">{{.Number}}</td><td class="num">{{.Hits}}</td><td><pre>{{.Code}}</pre></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+const reportStyle = `
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 0 0.5em; text-align: left; }
+tr.file td:first-child { padding-left: 2em; }
+tr.package { font-weight: bold; }
+.bar { display: inline-block; width: 100px; height: 0.8em; background: #e88; }
+.bar span { display: block; height: 100%; background: #8c8; }
+.source td { padding: 0 0.5em; vertical-align: top; }
+.source pre { margin: 0; }
+.num { text-align: right; color: #888; }
+tr.covered { background: #dfd; }
+tr.uncovered { background: #fdd; }
+`
+
+type reportStats struct {
+	Name    string
+	Covered int
+	Lines   int
+	Percent float64
+}
+
+func newReportStats(st coverageStats) reportStats {
+	return reportStats{Name: st.name, Covered: st.covered, Lines: st.total, Percent: st.percent()}
+}
+
+type reportFile struct {
+	reportStats
+	Base string
+	Link string
+}
+
+type reportPackage struct {
+	reportStats
+	Files []reportFile
+}
+
+type reportLine struct {
+	Number int
+	Hits   string
+	Class  string
+	Code   string
+}
+
+// writeHTMLReport writes a static site showing the coverage of the files
+// to dir: index.html lists the packages and files, and the coverage of each
+// line of a file is shown in files/<name>.html.
+func writeHTMLReport(dir string, files []*SourceFile) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	sorted := append([]*SourceFile(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	var pkgs []reportPackage
+	var total coverageStats
+	for _, sf := range sorted {
+		st := fileStats(sf)
+		total.add(st)
+
+		pkgName := path.Dir(sf.Name)
+		if len(pkgs) == 0 || pkgs[len(pkgs)-1].Name != pkgName {
+			pkgs = append(pkgs, reportPackage{reportStats: reportStats{Name: pkgName}})
+		}
+		p := &pkgs[len(pkgs)-1]
+		p.Covered += st.covered
+		p.Lines += st.total
+		p.Files = append(p.Files, reportFile{
+			reportStats: newReportStats(st),
+			Base:        path.Base(sf.Name),
+			Link:        "files/" + reportPagePath(sf.Name),
+		})
+
+		if err := writeHTMLFile(dir, sf, st); err != nil {
+			return err
+		}
+	}
+	for i := range pkgs {
+		pkgs[i].Percent = coverageStats{covered: pkgs[i].Covered, total: pkgs[i].Lines}.percent()
+	}
+
+	var buf bytes.Buffer
+	err := indexTemplate.Execute(&buf, struct {
+		Total    reportStats
+		Packages []reportPackage
+	}{newReportStats(total), pkgs})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "index.html"), buf.Bytes(), 0644)
+}
+
+// writeHTMLFile writes the page of a source file.
+func writeHTMLFile(dir string, sf *SourceFile, st coverageStats) error {
+	src := sf.Source
+	if src == "" {
+		b, err := ioutil.ReadFile(reportSourcePath(sf.Name))
+		if err != nil {
+			return fmt.Errorf("cannot read source of file %q: %v", sf.Name, err)
+		}
+		src = string(b)
+	}
+
+	var lines []reportLine
+	for i, code := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		l := reportLine{Number: i + 1, Code: code}
+		if i < len(sf.Coverage) {
+			if n, ok := sf.Coverage[i].(int); ok {
+				l.Hits = fmt.Sprint(n)
+				l.Class = "uncovered"
+				if n > 0 {
+					l.Class = "covered"
+				}
+			}
+		}
+		lines = append(lines, l)
+	}
+
+	page := reportPagePath(sf.Name)
+	var buf bytes.Buffer
+	err := fileTemplate.Execute(&buf, struct {
+		reportStats
+		Index  string
+		Source []reportLine
+	}{newReportStats(st), strings.Repeat("../", strings.Count(page, "/")+1) + "index.html", lines})
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(dir, "files", filepath.FromSlash(page))
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, buf.Bytes(), 0644)
+}
+
+// reportPagePath returns the path of the page of the source file name,
+// relative to the files directory of the report.
+func reportPagePath(name string) string {
+	name = strings.Replace(name, ":", "_", -1)
+	return strings.TrimLeft(name, "/") + ".html"
+}
+
+// reportSourcePath returns the local path of the source file name given by
+// getCoverallsSourceFileName.
+func reportSourcePath(name string) string {
+	if filepath.IsAbs(filepath.FromSlash(name)) {
+		return filepath.FromSlash(name)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if root, ok := findRepositoryRoot(wd); ok {
+			return filepath.Join(root, filepath.FromSlash(name))
+		}
+	}
+	return filepath.FromSlash(name)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteHTMLReport(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls_html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*SourceFile{
+		{
+			Name:     "pkg/b.go",
+			Source:   "package pkg\n\nfunc B() {\n\tprintln(\"<b>\")\n}\n",
+			Coverage: []interface{}{nil, nil, 1, 1, nil},
+		},
+		{
+			Name:     "pkg/sub/a.go",
+			Source:   "package sub\n\nfunc A() {\n}\n",
+			Coverage: []interface{}{nil, nil, 0, 0},
+		},
+	}
+	if err := writeHTMLReport(filepath.Join(dir, "report"), files); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(dir, "report", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Total: 2 of 4 lines covered (50.0%)",
+		`<td>pkg/sub</td><td>0</td><td>2</td>`,
+		`<a href="files/pkg/b.go.html">b.go</a>`,
+		`<a href="files/pkg/sub/a.go.html">a.go</a>`,
+	} {
+		if !strings.Contains(string(index), want) {
+			t.Errorf("expected index.html to contain %q:\n%s", want, index)
+		}
+	}
+
+	page, err := ioutil.ReadFile(filepath.Join(dir, "report", "files", "pkg", "b.go.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<a href="../../index.html">`,
+		`<tr class="covered"><td class="num">4</td><td class="num">1</td><td><pre>	println(&#34;&lt;b&gt;&#34;)</pre></td></tr>`,
+		`<tr class=""><td class="num">5</td><td class="num"></td><td><pre>}</pre></td></tr>`,
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("expected b.go.html to contain %q:\n%s", want, page)
+		}
+	}
+}
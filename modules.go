@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// A goModule is a module of the repository.
+type goModule struct {
+	path string // module path
+	dir  string // absolute directory
+}
+
+// findModules returns the modules in dir. If dir has a go.work file, those
+// are the modules it uses. Otherwise they are the module of dir and, if
+// nested is true, the modules in its subdirectories.
+func findModules(dir string, nested bool) ([]goModule, error) {
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "go.work")); err == nil {
+		return workModules(dir, content)
+	}
+
+	var mods []goModule
+	if !nested {
+		if path := findRootPackage(dir); path != "" {
+			mods = append(mods, goModule{path: path, dir: dir})
+		}
+		return mods, nil
+	}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			// the go command ignores these directories too
+			if p != dir && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == "go.mod" {
+			if path := findRootPackage(filepath.Dir(p)); path != "" {
+				mods = append(mods, goModule{path: path, dir: filepath.Dir(p)})
+			}
+		}
+		return nil
+	})
+	sortModules(mods)
+	return mods, err
+}
+
+// workModules returns the modules used by the go.work file in dir.
+func workModules(dir string, content []byte) ([]goModule, error) {
+	wf, err := modfile.ParseWork(filepath.Join(dir, "go.work"), content, nil)
+	if err != nil {
+		return nil, err
+	}
+	var mods []goModule
+	for _, use := range wf.Use {
+		modDir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(modDir) {
+			modDir = filepath.Join(dir, modDir)
+		}
+		if path := findRootPackage(modDir); path != "" {
+			mods = append(mods, goModule{path: path, dir: modDir})
+		}
+	}
+	sortModules(mods)
+	return mods, nil
+}
+
+func sortModules(mods []goModule) {
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].dir < mods[j].dir
+	})
+}
+
+// moduleOf returns the innermost of the modules containing the file
+// given by its path, or its local path if local is true.
+func moduleOf(mods []goModule, file string, local bool) (goModule, bool) {
+	var found goModule
+	foundRoot := ""
+	for _, mod := range mods {
+		root := mod.path
+		if local {
+			root = mod.dir
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if len(root) > len(foundRoot) {
+			found, foundRoot = mod, root
+		}
+	}
+	return found, foundRoot != ""
+}
+
+// splitJobByModule returns a job of the source files of each module,
+// flagged with the module path. The source files outside the modules are
+// left in a job of their own. The jobs are parallel, so that Coveralls
+// combines them into one build.
+func splitJobByModule(j *Job, mods []goModule) []*Job {
+	parallel := true
+	var jobs []*Job
+	index := make(map[string]*Job)
+	for _, sf := range j.SourceFiles {
+		mod, _ := moduleOf(mods, reportSourcePath(sf.Name), true)
+		mj, ok := index[mod.path]
+		if !ok {
+			j2 := *j
+			j2.SourceFiles = nil
+			j2.Parallel = &parallel
+			if mod.path != "" {
+				j2.FlagName = mod.path
+			}
+			mj = &j2
+			index[mod.path] = mj
+			jobs = append(jobs, mj)
+		}
+		mj.SourceFiles = append(mj.SourceFiles, sf)
+	}
+	return jobs
+}
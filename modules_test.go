@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles writes the files, given by their slash separated paths and
+// contents, to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindModules(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"go.mod":               "module example.com/root\n",
+		"sub/go.mod":           "module example.com/sub\n",
+		"sub/deeper/go.mod":    "module example.com/sub/deeper\n",
+		"testdata/go.mod":      "module example.com/testdata\n",
+		"vendor/x/go.mod":      "module example.com/vendored\n",
+		"work/go.work":         "go 1.18\n\nuse (\n\t./a\n\t../sub\n)\n",
+		"work/a/go.mod":        "module example.com/a\n",
+		"work/unused/go.mod":   "module example.com/unused\n",
+		"work/a/a.go":          "package a\n",
+		"sub/deeper/deeper.go": "package deeper\n",
+	})
+
+	tests := []struct {
+		dir    string
+		nested bool
+		want   []goModule
+	}{
+		{
+			dir:  dir,
+			want: []goModule{{"example.com/root", dir}},
+		},
+		{
+			dir:    dir,
+			nested: true,
+			want: []goModule{
+				{"example.com/root", dir},
+				{"example.com/sub", filepath.Join(dir, "sub")},
+				{"example.com/sub/deeper", filepath.Join(dir, "sub", "deeper")},
+				{"example.com/a", filepath.Join(dir, "work", "a")},
+				{"example.com/unused", filepath.Join(dir, "work", "unused")},
+			},
+		},
+		{
+			dir: filepath.Join(dir, "work"),
+			want: []goModule{
+				{"example.com/sub", filepath.Join(dir, "sub")},
+				{"example.com/a", filepath.Join(dir, "work", "a")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := findModules(tt.dir, tt.nested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findModules(%q, %v) = %v, want %v", tt.dir, tt.nested, got, tt.want)
+		}
+	}
+}
+
+func TestFindFileInModules(t *testing.T) {
+	t.Parallel()
+
+	root := filepath.FromSlash("/repo")
+	mods := []goModule{
+		{"example.com/root", root},
+		{"example.com/root/sub", filepath.Join(root, "sub")},
+		{"example.com/other", filepath.Join(root, "other")},
+	}
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"example.com/root/a.go", filepath.Join(root, "a.go")},
+		{"example.com/root/sub/b.go", filepath.Join(root, "sub", "b.go")},
+		{"example.com/root/subx/c.go", filepath.Join(root, "subx", "c.go")},
+		{"example.com/other/pkg/d.go", filepath.Join(root, "other", "pkg", "d.go")},
+	}
+	for _, tt := range tests {
+		got, err := findFile(mods, tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("findFile(%q) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestSplitJobByModule(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods := []goModule{
+		{"github.com/mattn/goveralls", wd},
+		{"github.com/mattn/goveralls/tester", filepath.Join(wd, "tester")},
+	}
+	parallel := false
+	j := &Job{
+		FlagName: "Unit",
+		Parallel: &parallel,
+		SourceFiles: []*SourceFile{
+			{Name: "goveralls.go"},
+			{Name: "tester/tester.go"},
+			{Name: "gocover.go"},
+			{Name: "/elsewhere/x.go"},
+		},
+	}
+
+	var got [][]string
+	for _, job := range splitJobByModule(j, mods) {
+		if job.Parallel == nil || !*job.Parallel {
+			t.Errorf("expected the job of %s to be parallel", job.FlagName)
+		}
+		entry := []string{job.FlagName}
+		for _, sf := range job.SourceFiles {
+			entry = append(entry, sf.Name)
+		}
+		got = append(got, entry)
+	}
+	want := [][]string{
+		{"github.com/mattn/goveralls", "goveralls.go", "gocover.go"},
+		{"github.com/mattn/goveralls/tester", "tester/tester.go"},
+		{"Unit", "/elsewhere/x.go"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitJobByModule() = %v, want %v", got, want)
+	}
+}
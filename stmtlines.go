@@ -0,0 +1,81 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+
+	"golang.org/x/tools/cover"
+)
+
+// statementLines returns the hit counts of the lines of the Go source src
+// holding statements. A line gets the count of the block containing its
+// innermost statement, so the counts of nested blocks aren't added up.
+// Lines without statements, like blank lines, comments and closing braces,
+// are left out, as are the statements outside of the blocks.
+func statementLines(filename string, src []byte, blocks []cover.ProfileBlock) (map[int]int, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	type lineStmt struct {
+		pos   token.Position
+		depth int
+	}
+	stmts := make(map[int]lineStmt)
+	depth := 0
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			depth--
+			return true
+		}
+		depth++
+		// the statements counted by the cover tool are the ones of the
+		// statement lists, and the if statements of else ifs
+		var list []ast.Stmt
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			list = n.List
+		case *ast.CaseClause:
+			list = n.Body
+		case *ast.CommClause:
+			list = n.Body
+		case *ast.IfStmt:
+			if elseIf, ok := n.Else.(*ast.IfStmt); ok {
+				list = []ast.Stmt{elseIf}
+			}
+		}
+		for _, s := range list {
+			for {
+				l, ok := s.(*ast.LabeledStmt)
+				if !ok {
+					break
+				}
+				s = l.Stmt
+			}
+			switch s.(type) {
+			case *ast.CaseClause, *ast.CommClause, *ast.EmptyStmt:
+				continue
+			}
+			p := fset.Position(s.Pos())
+			if old, ok := stmts[p.Line]; !ok || depth > old.depth {
+				stmts[p.Line] = lineStmt{pos: p, depth: depth}
+			}
+		}
+		return true
+	})
+
+	counts := make(map[int]int)
+	for line, st := range stmts {
+		for _, b := range blocks {
+			if !before(st.pos.Line, st.pos.Column, token.Position{Line: b.StartLine, Column: b.StartCol}) &&
+				before(st.pos.Line, st.pos.Column, token.Position{Line: b.EndLine, Column: b.EndCol}) {
+				counts[line] = b.Count
+				break
+			}
+		}
+	}
+	return counts, nil
+}
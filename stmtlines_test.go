@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+const stmtLinesTestSource = `package sl
+
+// Clamp limits n to max.
+func Clamp(n, max int) int {
+	if n > max {
+
+		// too big
+		return max
+	}
+	for i := 0; i < 2; i++ {
+		n += i
+	}
+	return n
+}
+
+func Abs(n int) int {
+	if n < 0 { n = -n }
+	return n
+}
+
+func Size(n int) string {
+	if n > 10 {
+		return "big"
+	} else if n > 5 {
+		return "medium"
+	}
+	return "small"
+}
+`
+
+// stmtLinesTestBlocks is the profile of stmtLinesTestSource after calling
+// Clamp(1, 10), Clamp(2, 10), Clamp(20, 10), Abs(3), Size(20), Size(7),
+// Size(1) and Size(2).
+var stmtLinesTestBlocks = []cover.ProfileBlock{
+	{StartLine: 5, StartCol: 2, EndLine: 5, EndCol: 13, NumStmt: 1, Count: 3},
+	{StartLine: 8, StartCol: 3, EndLine: 9, EndCol: 1, NumStmt: 1, Count: 1},
+	{StartLine: 10, StartCol: 2, EndLine: 10, EndCol: 25, NumStmt: 1, Count: 2},
+	{StartLine: 11, StartCol: 3, EndLine: 12, EndCol: 1, NumStmt: 1, Count: 4},
+	{StartLine: 13, StartCol: 2, EndLine: 13, EndCol: 10, NumStmt: 1, Count: 2},
+	{StartLine: 17, StartCol: 2, EndLine: 17, EndCol: 11, NumStmt: 1, Count: 1},
+	{StartLine: 17, StartCol: 11, EndLine: 17, EndCol: 19, NumStmt: 1, Count: 0},
+	{StartLine: 18, StartCol: 2, EndLine: 18, EndCol: 10, NumStmt: 1, Count: 1},
+	{StartLine: 22, StartCol: 2, EndLine: 22, EndCol: 12, NumStmt: 1, Count: 4},
+	{StartLine: 23, StartCol: 3, EndLine: 24, EndCol: 1, NumStmt: 1, Count: 1},
+	{StartLine: 24, StartCol: 9, EndLine: 24, EndCol: 18, NumStmt: 1, Count: 3},
+	{StartLine: 25, StartCol: 3, EndLine: 26, EndCol: 1, NumStmt: 1, Count: 1},
+	{StartLine: 27, StartCol: 2, EndLine: 27, EndCol: 16, NumStmt: 1, Count: 2},
+}
+
+func TestStatementLines(t *testing.T) {
+	t.Parallel()
+
+	got, err := statementLines("sl.go", []byte(stmtLinesTestSource), stmtLinesTestBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blank lines, comments and closing braces are left out, and the
+	// one-line if gets the count of its body; the line of an else if
+	// holds its condition
+	want := map[int]int{5: 3, 8: 1, 10: 2, 11: 4, 13: 2, 17: 0, 18: 1, 22: 4, 23: 1, 24: 3, 25: 1, 27: 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statementLines() = %v, want %v", got, want)
+	}
+
+	if _, err := statementLines("bad.go", []byte("package bad\nfunc {"), nil); err == nil {
+		t.Error("expected an error for a bad source")
+	}
+}
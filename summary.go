@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// coverageStats is the number of covered and relevant lines of a file or
+// a package, or of covered and all statements for the minimum coverage.
+type coverageStats struct {
+	name    string
+	covered int
+	total   int
+}
+
+func (s *coverageStats) add(o coverageStats) {
+	s.covered += o.covered
+	s.total += o.total
+}
+
+func (s coverageStats) percent() float64 {
+	if s.total == 0 {
+		return 100
+	}
+	return float64(s.covered) * 100 / float64(s.total)
+}
+
+// fileStats counts the lines of sf. Lines without coverage data aren't
+// relevant.
+func fileStats(sf *SourceFile) coverageStats {
+	st := coverageStats{name: sf.Name}
+	for _, c := range sf.Coverage {
+		n, ok := c.(int)
+		if !ok {
+			continue
+		}
+		st.total++
+		if n > 0 {
+			st.covered++
+		}
+	}
+	return st
+}
+
+// summarize returns the stats of the packages and the files, and the total.
+// Packages and files are sorted from the worst coverage.
+func summarize(files []*SourceFile) (pkgs, fileList []coverageStats, total coverageStats) {
+	pkgIndex := make(map[string]int)
+	for _, sf := range files {
+		st := fileStats(sf)
+		fileList = append(fileList, st)
+		total.add(st)
+
+		dir := path.Dir(sf.Name)
+		i, ok := pkgIndex[dir]
+		if !ok {
+			i = len(pkgs)
+			pkgIndex[dir] = i
+			pkgs = append(pkgs, coverageStats{name: dir})
+		}
+		pkgs[i].add(st)
+	}
+	sortStats(pkgs)
+	sortStats(fileList)
+	return pkgs, fileList, total
+}
+
+func sortStats(stats []coverageStats) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		pi, pj := stats[i].percent(), stats[j].percent()
+		if pi != pj {
+			return pi < pj
+		}
+		return stats[i].name < stats[j].name
+	})
+}
+
+// printSummary writes the coverage of the packages and the files to w.
+// If limit is positive, only the worst limit packages and files are shown.
+func printSummary(w io.Writer, files []*SourceFile, limit int) {
+	pkgs, fileList, total := summarize(files)
+	if limit > 0 {
+		if len(pkgs) > limit {
+			pkgs = pkgs[:limit]
+		}
+		if len(fileList) > limit {
+			fileList = fileList[:limit]
+		}
+	}
+
+	width := len("PACKAGE")
+	for _, stats := range [][]coverageStats{pkgs, fileList} {
+		for _, st := range stats {
+			if len(st.name) > width {
+				width = len(st.name)
+			}
+		}
+	}
+	row := func(name, covered, total, percent string) {
+		fmt.Fprintf(w, "%-*s  %7s  %7s  %8s\n", width, name, covered, total, percent)
+	}
+	rows := func(header string, stats []coverageStats) {
+		row(header, "COVERED", "LINES", "COVERAGE")
+		for _, st := range stats {
+			row(st.name, fmt.Sprint(st.covered), fmt.Sprint(st.total), fmt.Sprintf("%.1f%%", st.percent()))
+		}
+		fmt.Fprintln(w)
+	}
+	rows("PACKAGE", pkgs)
+	rows("FILE", fileList)
+	row("TOTAL", fmt.Sprint(total.covered), fmt.Sprint(total.total), fmt.Sprintf("%.1f%%", total.percent()))
+}
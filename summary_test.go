@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintSummary(t *testing.T) {
+	t.Parallel()
+
+	files := []*SourceFile{
+		{Name: "a/a.go", Coverage: []interface{}{nil, 1, 0, 2}},
+		{Name: "a/b.go", Coverage: []interface{}{1, 1}},
+		{Name: "c/c.go", Coverage: []interface{}{0, nil, 0, 0}},
+		{Name: "main.go", Coverage: []interface{}{nil}},
+	}
+
+	tests := []struct {
+		limit int
+		want  string
+	}{
+		{
+			limit: 0,
+			want: `PACKAGE  COVERED    LINES  COVERAGE
+c              0        3      0.0%
+a              4        5     80.0%
+.              0        0    100.0%
+
+FILE     COVERED    LINES  COVERAGE
+c/c.go         0        3      0.0%
+a/a.go         2        3     66.7%
+a/b.go         2        2    100.0%
+main.go        0        0    100.0%
+
+TOTAL          4        8     50.0%
+`,
+		},
+		{
+			limit: 1,
+			want: `PACKAGE  COVERED    LINES  COVERAGE
+c              0        3      0.0%
+
+FILE     COVERED    LINES  COVERAGE
+c/c.go         0        3      0.0%
+
+TOTAL          4        8     50.0%
+`,
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		printSummary(&buf, files, tt.limit)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("printSummary(limit=%d) =\n%s\nwant\n%s", tt.limit, got, tt.want)
+		}
+	}
+}
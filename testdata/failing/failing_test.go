@@ -0,0 +1,13 @@
+package failing
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	if got := Sign(1); got != 1 {
+		t.Errorf("Sign(1) = %d", got)
+	}
+	// fails on purpose for the tests of -continue-on-failure
+	if got := Sign(-1); got != 1 {
+		t.Errorf("Sign(-1) = %d", got)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build extra
+// +build extra
+
+package tagged
+
+// Extra is built with the extra tag only.
+func Extra() int {
+	return 2
+}
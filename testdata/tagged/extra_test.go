@@ -0,0 +1,12 @@
+//go:build extra
+// +build extra
+
+package tagged
+
+import "testing"
+
+func TestExtra(t *testing.T) {
+	if Extra() != 2 {
+		t.Error("unexpected Extra")
+	}
+}
@@ -0,0 +1,6 @@
+package tagged
+
+// Plain is built without tags.
+func Plain() int {
+	return 1
+}
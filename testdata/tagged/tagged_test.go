@@ -0,0 +1,9 @@
+package tagged
+
+import "testing"
+
+func TestPlain(t *testing.T) {
+	if Plain() != 1 {
+		t.Error("unexpected Plain")
+	}
+}
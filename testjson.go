@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/cover"
+)
+
+// slowestTests is the number of tests listed as the slowest in the test
+// summary.
+const slowestTests = 5
+
+// A testEvent is an event of 'go test -json'; see 'go doc test2json'.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64 // seconds
+	Output  string
+}
+
+// A testResult is the outcome of a test, or of the tests of a package if
+// test is empty.
+type testResult struct {
+	pkg     string
+	test    string
+	action  string // pass, fail or skip
+	elapsed time.Duration
+	output  string // kept for failures only
+}
+
+// testResults collects the results of the tests from the events of
+// 'go test -json'.
+type testResults struct {
+	results []testResult
+	output  map[[2]string]*bytes.Buffer // output of the running tests
+}
+
+func newTestResults() *testResults {
+	return &testResults{output: make(map[[2]string]*bytes.Buffer)}
+}
+
+func (r *testResults) add(e testEvent) {
+	key := [2]string{e.Package, e.Test}
+	switch e.Action {
+	case "output":
+		buf, ok := r.output[key]
+		if !ok {
+			buf = new(bytes.Buffer)
+			r.output[key] = buf
+		}
+		buf.WriteString(e.Output)
+	case "pass", "fail", "skip":
+		res := testResult{
+			pkg:     e.Package,
+			test:    e.Test,
+			action:  e.Action,
+			elapsed: time.Duration(e.Elapsed * float64(time.Second)),
+		}
+		if buf, ok := r.output[key]; ok {
+			if e.Action == "fail" {
+				res.output = buf.String()
+			}
+			delete(r.output, key)
+		}
+		r.results = append(r.results, res)
+	}
+}
+
+// merge adds the results of o to r.
+func (r *testResults) merge(o *testResults) {
+	r.results = append(r.results, o.results...)
+}
+
+// testJSONWriter decodes the events of 'go test -json' written to it into
+// results, and writes their output to w. Lines that aren't events, like
+// build errors, are written to w as is.
+type testJSONWriter struct {
+	w       io.Writer
+	results *testResults
+	buf     []byte
+}
+
+func (tw *testJSONWriter) Write(p []byte) (int, error) {
+	tw.buf = append(tw.buf, p...)
+	for {
+		i := bytes.IndexByte(tw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := tw.line(tw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		tw.buf = tw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush decodes the last line if it isn't terminated by a newline.
+func (tw *testJSONWriter) flush() error {
+	if len(tw.buf) == 0 {
+		return nil
+	}
+	err := tw.line(tw.buf)
+	tw.buf = nil
+	return err
+}
+
+func (tw *testJSONWriter) line(b []byte) error {
+	var e testEvent
+	if bytes.HasPrefix(b, []byte("{")) && json.Unmarshal(b, &e) == nil {
+		tw.results.add(e)
+		_, err := io.WriteString(tw.w, e.Output)
+		return err
+	}
+	_, err := tw.w.Write(b)
+	return err
+}
+
+// readTestJSON reads the results of the tests from the file fn of
+// 'go test -json' output.
+func readTestJSON(fn string) (*testResults, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results := newTestResults()
+	tw := &testJSONWriter{w: ioutil.Discard, results: results}
+	if _, err := io.Copy(tw, f); err != nil {
+		return nil, err
+	}
+	if err := tw.flush(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// pkgTestStats counts the results of the tests of a package.
+type pkgTestStats struct {
+	name                 string
+	passed, failed, skip int
+	elapsed              time.Duration
+}
+
+// printTestSummary writes the number of passed, failed and skipped tests of
+// every package with their statement coverage in profs, the slowest tests
+// and the output of the failed tests to w.
+func printTestSummary(w io.Writer, results *testResults, profs []*cover.Profile) {
+	var pkgs []*pkgTestStats
+	pkgIndex := make(map[string]*pkgTestStats)
+	var tests, failed []testResult
+	for _, res := range results.results {
+		st, ok := pkgIndex[res.pkg]
+		if !ok {
+			st = &pkgTestStats{name: res.pkg}
+			pkgIndex[res.pkg] = st
+			pkgs = append(pkgs, st)
+		}
+		if res.test == "" {
+			st.elapsed = res.elapsed
+			continue
+		}
+		tests = append(tests, res)
+		switch res.action {
+		case "pass":
+			st.passed++
+		case "fail":
+			st.failed++
+			failed = append(failed, res)
+		case "skip":
+			st.skip++
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].name < pkgs[j].name
+	})
+
+	coverage := make(map[string]string)
+	covStats, _ := statementStats(profs)
+	for _, st := range covStats {
+		coverage[st.name] = fmt.Sprintf("%.1f%%", st.percent())
+	}
+
+	width := len("PACKAGE")
+	for _, st := range pkgs {
+		if len(st.name) > width {
+			width = len(st.name)
+		}
+	}
+	fmt.Fprintf(w, "%-*s  %5s  %5s  %5s  %8s  %8s\n", width, "PACKAGE", "PASS", "FAIL", "SKIP", "TIME", "COVERAGE")
+	for _, st := range pkgs {
+		cov, ok := coverage[st.name]
+		if !ok {
+			cov = "-"
+		}
+		fmt.Fprintf(w, "%-*s  %5d  %5d  %5d  %8s  %8s\n", width, st.name, st.passed, st.failed, st.skip, formatElapsed(st.elapsed), cov)
+	}
+
+	sort.SliceStable(tests, func(i, j int) bool {
+		return tests[i].elapsed > tests[j].elapsed
+	})
+	if len(tests) > slowestTests {
+		tests = tests[:slowestTests]
+	}
+	if len(tests) > 0 {
+		fmt.Fprintln(w, "\nSLOWEST TESTS")
+		for _, res := range tests {
+			fmt.Fprintf(w, "%8s  %s %s\n", formatElapsed(res.elapsed), res.pkg, res.test)
+		}
+	}
+
+	if len(failed) > 0 {
+		fmt.Fprintln(w, "\nFAILED TESTS")
+		for _, res := range failed {
+			fmt.Fprintf(w, "%s %s\n", res.pkg, res.test)
+			if res.output == "" {
+				continue
+			}
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(res.output, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s", line)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func formatElapsed(d time.Duration) string {
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
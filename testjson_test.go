@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+const testJSONOutput = `{"Action":"run","Package":"example.com/a","Test":"TestA"}
+{"Action":"output","Package":"example.com/a","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestA","Output":"--- PASS: TestA (1.50s)\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestA","Elapsed":1.5}
+{"Action":"run","Package":"example.com/a","Test":"TestB"}
+{"Action":"output","Package":"example.com/a","Test":"TestB","Output":"=== RUN   TestB\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestB","Output":"    a_test.go:10: got 1, want 2\n"}
+{"Action":"output","Package":"example.com/a","Test":"TestB","Output":"--- FAIL: TestB (0.20s)\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestB","Elapsed":0.2}
+{"Action":"output","Package":"example.com/a","Output":"FAIL\n"}
+{"Action":"fail","Package":"example.com/a","Elapsed":1.75}
+# example.com/b
+{"Action":"run","Package":"example.com/b","Test":"TestC"}
+{"Action":"skip","Package":"example.com/b","Test":"TestC","Elapsed":0}
+{"Action":"pass","Package":"example.com/b","Elapsed":0.01}`
+
+func TestTestSummary(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "goveralls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testJSONOutput); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	results, err := readTestJSON(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	profs := []*cover.Profile{{
+		FileName: "example.com/a/a.go",
+		Blocks: []cover.ProfileBlock{
+			{NumStmt: 3, Count: 1},
+			{NumStmt: 1, Count: 0},
+		},
+	}}
+
+	var buf bytes.Buffer
+	printTestSummary(&buf, results, profs)
+	want := `PACKAGE         PASS   FAIL   SKIP      TIME  COVERAGE
+example.com/a      1      1      0     1.75s     75.0%
+example.com/b      0      0      1     0.01s         -
+
+SLOWEST TESTS
+   1.50s  example.com/a TestA
+   0.20s  example.com/a TestB
+   0.00s  example.com/b TestC
+
+FAILED TESTS
+example.com/a TestB
+    === RUN   TestB
+        a_test.go:10: got 1, want 2
+    --- FAIL: TestB (0.20s)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("printTestSummary() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTestJSONWriter(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	tw := &testJSONWriter{w: &out, results: newTestResults()}
+	// events split across writes
+	for _, s := range []string{
+		`{"Action":"output","Package":"p","Output":"ok  \tp\n"}` + "\n" + `{"Action":"pa`,
+		`ss","Package":"p"}` + "\nbuild error\n",
+	} {
+		if _, err := tw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "ok  \tp\nbuild error\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if len(tw.results.results) != 1 || tw.results.results[0].action != "pass" {
+		t.Errorf("unexpected results: %+v", tw.results.results)
+	}
+}
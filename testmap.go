@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// A testMap is the index of the tests covering each line. Files are keyed
+// by their names on coveralls, and tests are named by their package and
+// function, like "example.com/pkg.TestFoo".
+type testMap struct {
+	Files map[string]map[int][]string `json:"files"`
+}
+
+// add records that test covers the lines of the covered blocks of the file
+// name, taken from the profile of test alone.
+func (m *testMap) add(name, test string, blocks []cover.ProfileBlock) {
+	lines, ok := m.Files[name]
+	if !ok {
+		lines = make(map[int][]string)
+		m.Files[name] = lines
+	}
+	for _, b := range blocks {
+		if b.Count == 0 {
+			continue
+		}
+		for i := b.StartLine; i <= b.EndLine; i++ {
+			tests := lines[i]
+			if len(tests) > 0 && tests[len(tests)-1] == test {
+				continue
+			}
+			lines[i] = append(tests, test)
+		}
+	}
+	if len(lines) == 0 {
+		delete(m.Files, name)
+	}
+}
+
+var testFuncRe = regexp.MustCompile(`^(Test|Example|Fuzz)\w*$`)
+
+// listTests returns the tests and examples of the package pkg of the
+// module in dir with the build tags.
+func listTests(dir, pkg, tags string) ([]string, error) {
+	args := []string{"test", "-list", "."}
+	if tags != "" {
+		args = append(args, "-tags", tags)
+	}
+	cmd := exec.Command("go", append(args, pkg)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the tests of %s: %v: %s", pkg, err, out)
+	}
+	var tests []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if testFuncRe.MatchString(line) {
+			tests = append(tests, line)
+		}
+	}
+	return tests, nil
+}
+
+// runTestFunc runs only the test of the package pkg of the module in dir
+// with the build tags and parses its profile.
+func runTestFunc(ctx context.Context, dir, pkg, test, coverpkg, tags string) pkgTestResult {
+	f, err := ioutil.TempFile("", "goveralls")
+	if err != nil {
+		return pkgTestResult{err: err}
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	args := testArgs(f.Name(), coverpkg, tags, false)
+	args = append(args, "-run", "^"+regexp.QuoteMeta(test)+"$", pkg)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	// The profile is written even if the test fails.
+	pfs, perr := cover.ParseProfiles(f.Name())
+	if err != nil {
+		return pkgTestResult{profs: pfs, stdout: out, err: fmt.Errorf("%v: %s", err, out)}
+	}
+	if perr != nil {
+		return pkgTestResult{stdout: out, err: perr}
+	}
+	return pkgTestResult{profs: pfs, stdout: out}
+}
+
+// addTests runs every test of the packages of the module in dir, or in the
+// current directory if dir is empty, on its own with the build tags and adds
+// the lines it covers to m. It returns the number of tests run.
+func (m *testMap) addTests(mods []goModule, dir, tags string) (int, error) {
+	pkgs, err := getPkgs(dir, *pkg, tags)
+	if err != nil {
+		return 0, err
+	}
+	coverpkg, err := coverPkgFlag(dir, pkgs)
+	if err != nil {
+		return 0, err
+	}
+
+	// tests are named by their package and function
+	var tests []string
+	for _, p := range pkgs {
+		names, err := listTests(dir, p, tags)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range names {
+			tests = append(tests, p+"."+name)
+		}
+	}
+
+	err = runPkgTests(tests, func(ctx context.Context, test string) pkgTestResult {
+		i := strings.LastIndex(test, ".")
+		return runTestFunc(ctx, dir, test[:i], test[i+1:], coverpkg, tags)
+	}, func(test string, r pkgTestResult) error {
+		if *show {
+			fmt.Println("goveralls:", test)
+		}
+		if *verbose {
+			os.Stdout.Write(r.stdout)
+		}
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "goveralls: %s failed: %v\n", test, r.err)
+		}
+		for _, prof := range r.profs {
+			file, err := findFile(mods, prof.FileName)
+			if err != nil {
+				return fmt.Errorf("cannot find file %q: %v", prof.FileName, err)
+			}
+			m.add(getCoverallsSourceFileName(file), test, prof.Blocks)
+		}
+		return nil
+	})
+	return len(tests), err
+}
+
+// buildTestMap runs every test of the packages on its own and writes the
+// index of the tests covering each line to the JSON file fn. Like the
+// coverage, the tests are run with each set of build tags, and in every
+// module with -multimodule.
+func buildTestMap(fn string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	mods, err := findModules(wd, *multiModule)
+	if err != nil {
+		return fmt.Errorf("cannot find modules: %v", err)
+	}
+	dirs := []goModule{{}}
+	if *multiModule {
+		dirs = mods
+	}
+
+	m := &testMap{Files: make(map[string]map[int][]string)}
+	var n int
+	for _, tags := range tagSets() {
+		for _, mod := range dirs {
+			c, err := m.addTests(mods, mod.dir, tags)
+			if err != nil {
+				if mod.path != "" {
+					err = fmt.Errorf("%s: %v", mod.path, err)
+				}
+				if len(tagSetFlags) > 0 {
+					err = fmt.Errorf("tags %q: %v", tags, err)
+				}
+				return err
+			}
+			n += c
+		}
+	}
+	for _, lines := range m.Files {
+		for i, tests := range lines {
+			// a test run with several sets of tags is listed once
+			sort.Strings(tests)
+			j := 0
+			for _, test := range tests {
+				if j == 0 || tests[j-1] != test {
+					tests[j] = test
+					j++
+				}
+			}
+			lines[i] = tests[:j]
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		return fmt.Errorf("cannot write test map: %v", err)
+	}
+	fmt.Printf("test map of %d tests written to %s\n", n, fn)
+	return nil
+}
+
+// readTestMap reads the index written by buildTestMap from the file fn.
+func readTestMap(fn string) (*testMap, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read test map: %v", err)
+	}
+	var m testMap
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse test map %q: %v", fn, err)
+	}
+	return &m, nil
+}
+
+// coveredBy writes the tests of m covering the line given as "file:line"
+// to w, one per line. The file matches the files of m whose names end with
+// it.
+func coveredBy(w io.Writer, m *testMap, query string) error {
+	i := strings.LastIndex(query, ":")
+	if i < 0 {
+		return fmt.Errorf("bad line %q: expected file:line", query)
+	}
+	file := strings.TrimPrefix(path.Clean(strings.Replace(query[:i], "\\", "/", -1)), "./")
+	line, err := strconv.Atoi(query[i+1:])
+	if err != nil {
+		return fmt.Errorf("bad line %q: %v", query, err)
+	}
+
+	var names []string
+	for name := range m.Files {
+		if name == file || strings.HasSuffix(name, "/"+file) {
+			names = append(names, name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return fmt.Errorf("no tests cover any line of %s", file)
+	case 1:
+	default:
+		sort.Strings(names)
+		return fmt.Errorf("ambiguous file %s matches %s", file, strings.Join(names, ", "))
+	}
+
+	for _, test := range m.Files[names[0]][line] {
+		if _, err := fmt.Fprintln(w, test); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+func TestTestMap(t *testing.T) {
+	t.Parallel()
+
+	m := &testMap{Files: make(map[string]map[int][]string)}
+	m.add("pkg/a.go", "example.com/pkg.TestA", []cover.ProfileBlock{
+		{StartLine: 3, EndLine: 5, Count: 1},
+		{StartLine: 5, EndLine: 6, Count: 2},
+		{StartLine: 8, EndLine: 9, Count: 0},
+	})
+	m.add("pkg/a.go", "example.com/pkg.TestB", []cover.ProfileBlock{
+		{StartLine: 5, EndLine: 5, Count: 1},
+	})
+	m.add("pkg/b.go", "example.com/pkg.TestB", []cover.ProfileBlock{
+		{StartLine: 1, EndLine: 2, Count: 0},
+	})
+	m.add("other/a.go", "example.com/other.TestC", []cover.ProfileBlock{
+		{StartLine: 1, EndLine: 1, Count: 1},
+	})
+
+	tests := []struct {
+		query string
+		want  string
+		err   bool
+	}{
+		{query: "pkg/a.go:4", want: "example.com/pkg.TestA\n"},
+		{query: "./pkg/a.go:5", want: "example.com/pkg.TestA\nexample.com/pkg.TestB\n"},
+		{query: "pkg/a.go:8", want: ""},
+		{query: "other/a.go:1", want: "example.com/other.TestC\n"},
+		// not covered at all
+		{query: "pkg/b.go:1", err: true},
+		// matching pkg/a.go and other/a.go
+		{query: "a.go:1", err: true},
+		{query: "pkg/a.go", err: true},
+		{query: "pkg/a.go:x", err: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := coveredBy(&buf, m, tt.query)
+		if tt.err {
+			if err == nil {
+				t.Errorf("coveredBy(%q): expected an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("coveredBy(%q): %v", tt.query, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("coveredBy(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
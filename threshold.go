@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/cover"
+)
+
+// A coverageThreshold is the minimum statement coverage of the packages
+// matching pattern.
+type coverageThreshold struct {
+	pattern string
+	min     float64
+}
+
+// parseThresholds reads the thresholds from r. Each line is a package
+// pattern and a percentage separated by spaces; empty lines and lines
+// starting with "#" are ignored. Patterns are either package paths, which
+// may contain wildcards of path.Match, or end with "/..." to match the
+// package and all its subpackages.
+func parseThresholds(r io.Reader) ([]coverageThreshold, error) {
+	var thresholds []coverageThreshold
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a pattern and a percentage: %q", lineNo, line)
+		}
+		minimum, err := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad percentage: %v", lineNo, err)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("line %d: bad pattern %q: %v", lineNo, fields[0], err)
+		}
+		thresholds = append(thresholds, coverageThreshold{pattern: fields[0], min: minimum})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+// matchPackage reports whether the package path pkg matches pattern.
+func matchPackage(pattern, pkg string) bool {
+	if pattern == "..." {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/...") {
+		prefix := strings.TrimSuffix(pattern, "/...")
+		return pkg == prefix || strings.HasPrefix(pkg, prefix+"/")
+	}
+	ok, _ := path.Match(pattern, pkg)
+	return ok
+}
+
+// statementStats counts the covered and all statements of the profiles
+// per package, and in total.
+func statementStats(profs []*cover.Profile) (pkgs []coverageStats, total coverageStats) {
+	pkgIndex := make(map[string]int)
+	for _, prof := range profs {
+		dir := path.Dir(prof.FileName)
+		i, ok := pkgIndex[dir]
+		if !ok {
+			i = len(pkgs)
+			pkgIndex[dir] = i
+			pkgs = append(pkgs, coverageStats{name: dir})
+		}
+		for _, b := range prof.Blocks {
+			st := coverageStats{total: b.NumStmt}
+			if b.Count > 0 {
+				st.covered = b.NumStmt
+			}
+			pkgs[i].add(st)
+			total.add(st)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].name < pkgs[j].name
+	})
+	return pkgs, total
+}
+
+// A coverageError reports the packages whose coverage is below the
+// minimum.
+type coverageError struct {
+	failures []string
+}
+
+func (e *coverageError) Error() string {
+	return "coverage is below the minimum:\n" + strings.Join(e.failures, "\n")
+}
+
+// readThresholds reads the thresholds from the file fn.
+func readThresholds(fn string) ([]coverageThreshold, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	thresholds, err := parseThresholds(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return thresholds, nil
+}
+
+// evalCoverage returns a *coverageError if the total statement coverage of
+// the profiles is below minTotal, or the coverage of a package is below the last
+// threshold matching it.
+func evalCoverage(profs []*cover.Profile, minTotal float64, thresholds []coverageThreshold) error {
+	pkgs, total := statementStats(profs)
+	return evalStats(pkgs, total, minTotal, thresholds)
+}
+
+// evalLineCoverage returns a *coverageError if the total line coverage of
+// the files is below minTotal.
+func evalLineCoverage(files []*SourceFile, minTotal float64) error {
+	_, _, total := summarize(files)
+	return evalStats(nil, total, minTotal, nil)
+}
+
+func evalStats(pkgs []coverageStats, total coverageStats, minTotal float64, thresholds []coverageThreshold) error {
+	var failures []string
+	for _, st := range pkgs {
+		var th *coverageThreshold
+		for i := range thresholds {
+			if matchPackage(thresholds[i].pattern, st.name) {
+				th = &thresholds[i]
+			}
+		}
+		if th != nil && st.percent() < th.min {
+			failures = append(failures, fmt.Sprintf("  %s: %.1f%% < %.1f%% (%s)", st.name, st.percent(), th.min, th.pattern))
+		}
+	}
+	if total.percent() < minTotal {
+		failures = append(failures, fmt.Sprintf("  total: %.1f%% < %.1f%%", total.percent(), minTotal))
+	}
+	if len(failures) > 0 {
+		return &coverageError{failures: failures}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+func TestParseThresholds(t *testing.T) {
+	t.Parallel()
+
+	got, err := parseThresholds(strings.NewReader(`
+# minimum coverage per package
+github.com/mattn/goveralls/...  60
+github.com/mattn/goveralls/coveralls 80.5%
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []coverageThreshold{
+		{pattern: "github.com/mattn/goveralls/...", min: 60},
+		{pattern: "github.com/mattn/goveralls/coveralls", min: 80.5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseThresholds() = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"pkg", "pkg 50 extra", "pkg fifty", "[ 50"} {
+		if _, err := parseThresholds(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseThresholds(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestMatchPackage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		pattern string
+		pkg     string
+		want    bool
+	}{
+		{"...", "example.com/a", true},
+		{"example.com/a/...", "example.com/a", true},
+		{"example.com/a/...", "example.com/a/b/c", true},
+		{"example.com/a/...", "example.com/ab", false},
+		{"example.com/*/b", "example.com/a/b", true},
+		{"example.com/*/b", "example.com/a/c/b", false},
+		{"example.com/a", "example.com/a", true},
+	}
+	for _, tt := range tests {
+		if got := matchPackage(tt.pattern, tt.pkg); got != tt.want {
+			t.Errorf("matchPackage(%q, %q) = %v, want %v", tt.pattern, tt.pkg, got, tt.want)
+		}
+	}
+}
+
+func TestEvalCoverage(t *testing.T) {
+	t.Parallel()
+
+	profs := []*cover.Profile{
+		{
+			FileName: "example.com/a/a.go",
+			Blocks: []cover.ProfileBlock{
+				{NumStmt: 3, Count: 1},
+				{NumStmt: 1, Count: 0},
+			},
+		},
+		{
+			FileName: "example.com/b/b.go",
+			Blocks: []cover.ProfileBlock{
+				{NumStmt: 1, Count: 2},
+				{NumStmt: 3, Count: 0},
+			},
+		},
+	}
+
+	if err := evalCoverage(profs, 50, nil); err != nil {
+		t.Errorf("expected total coverage of 50%% to pass, but got %v", err)
+	}
+
+	thresholds := []coverageThreshold{
+		{pattern: "example.com/...", min: 20},
+		{pattern: "example.com/b", min: 30},
+	}
+	err := evalCoverage(profs, 60, thresholds)
+	var coverageErr *coverageError
+	if !errors.As(err, &coverageErr) {
+		t.Fatalf("expected *coverageError, but got %v", err)
+	}
+	want := []string{
+		"  example.com/b: 25.0% < 30.0% (example.com/b)",
+		"  total: 50.0% < 60.0%",
+	}
+	if !reflect.DeepEqual(coverageErr.failures, want) {
+		t.Errorf("failures = %q, want %q", coverageErr.failures, want)
+	}
+}